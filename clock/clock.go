@@ -0,0 +1,155 @@
+// Package clock abstracts time so timed caches can be tested deterministically.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and schedules functions.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc calls f after duration d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled by AfterFunc. *time.Timer implements Timer.
+type Timer interface {
+	// Reset changes the timer to expire after duration d, returns whether
+	// the timer had been active.
+	Reset(d time.Duration) bool
+
+	// Stop prevents the timer from firing, returns whether the timer had
+	// been active.
+	Stop() bool
+}
+
+// Real is the clock backed by package time.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Fake is a clock which only moves when advanced. Must be used as a pointer.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	f    func()
+	fake *Fake
+	when time.Time
+}
+
+// NewFake creates a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now: now,
+	}
+}
+
+// Now returns the fake time.
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// AfterFunc schedules f to be called once the clock has been advanced by d.
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{
+		f:    f,
+		fake: c,
+		when: c.now.Add(d),
+	}
+
+	c.add(t)
+
+	return t
+}
+
+// Advance moves the clock forward by d. Timers which expire are called in
+// order of expiry from the calling goroutine, each seeing Now as its expiry
+// time, or the current time for timers which had already expired, so Advance
+// returns only once they have all finished.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+
+	end := c.now.Add(d)
+
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+
+	c.now = end
+
+	c.mu.Unlock()
+}
+
+// add inserts t into the timers, keeping them sorted by expiry. Must be called
+// with the mutex held.
+func (c *Fake) add(t *fakeTimer) {
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].when.After(t.when)
+	})
+
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+}
+
+// remove deletes t from the timers, returns whether it was present. Must be
+// called with the mutex held.
+func (c *Fake) remove(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+
+	active := t.fake.remove(t)
+	t.when = t.fake.now.Add(d)
+	t.fake.add(t)
+
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+
+	return t.fake.remove(t)
+}
@@ -0,0 +1,112 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	var fired []int
+
+	c.AfterFunc(2*time.Second, func() {
+		if !c.Now().Equal(start.Add(2 * time.Second)) {
+			t.Error("timer saw wrong time")
+		}
+		fired = append(fired, 2)
+	})
+	c.AfterFunc(time.Second, func() {
+		fired = append(fired, 1)
+
+		// Timers scheduled from a timer within the advance also fire.
+		c.AfterFunc(500*time.Millisecond, func() {
+			fired = append(fired, 15)
+		})
+	})
+	stopped := c.AfterFunc(time.Second, func() {
+		t.Error("stopped timer fired")
+	})
+
+	if !stopped.Stop() {
+		t.Fatal("timer not active")
+	}
+
+	c.Advance(1500 * time.Millisecond)
+
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 15 {
+		t.Fatalf("unexpected timers %v", fired)
+	}
+
+	c.Advance(time.Second)
+
+	if len(fired) != 3 || fired[2] != 2 {
+		t.Fatalf("unexpected timers %v", fired)
+	}
+
+	if !c.Now().Equal(start.Add(2500 * time.Millisecond)) {
+		t.Fatal("wrong time after advance")
+	}
+
+	if stopped.Stop() {
+		t.Fatal("stopped timer active")
+	}
+
+	reset := c.AfterFunc(time.Second, func() {
+		fired = append(fired, 3)
+	})
+
+	if !reset.Reset(3 * time.Second) {
+		t.Fatal("timer not active")
+	}
+
+	c.Advance(2 * time.Second)
+
+	if len(fired) != 3 {
+		t.Fatalf("unexpected timers %v", fired)
+	}
+
+	c.Advance(time.Second)
+
+	if len(fired) != 4 || fired[3] != 3 {
+		t.Fatalf("unexpected timers %v", fired)
+	}
+}
+
+// Test that timers which had already expired fire without moving the clock
+// backwards.
+func TestFakeExpired(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	var fired int
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		c.AfterFunc(d, func() {
+			fired++
+			if c.Now().Before(start) {
+				t.Error("clock moved backwards")
+			}
+		})
+	}
+
+	reset := c.AfterFunc(time.Hour, func() {
+		fired++
+		if c.Now().Before(start) {
+			t.Error("clock moved backwards")
+		}
+	})
+
+	reset.Reset(-time.Minute)
+
+	c.Advance(0)
+
+	if fired != 3 {
+		t.Fatalf("expected %d timers got %d", 3, fired)
+	}
+
+	if !c.Now().Equal(start) {
+		t.Fatal("wrong time after advance")
+	}
+}
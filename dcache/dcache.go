@@ -2,86 +2,536 @@
 package dcache
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
+// ErrClosed is returned when using a closed cache.
+var ErrClosed = errors.New("dcache: cache closed")
+
 // DCache (delayed cache) is a cache as a self-populating ring buffer.
-// The cache is only repopulated when all values have been withdrawn.
-type DCache struct {
-	cache []interface{}
-	fill  func() interface{}
-	index int
-	mu    sync.Mutex
-	size  int
+// The cache is only repopulated when all values have been withdrawn, unless
+// prefilling with WithPrefill.
+type DCache[T any] struct {
+	batch   func(context.Context, int) ([]T, error)
+	cache   []T
+	cancel  context.CancelFunc
+	ctx     context.Context
+	fill    func() (T, error)
+	index   int
+	mu      sync.Mutex
+	next    []T
+	opts    options
+	prefill chan []T
+	size    int
+	wipe    func(*T)
+}
+
+// Option configures a delayed cache.
+type Option func(*options)
+
+type options struct {
+	low      int
+	parallel int
+	wipe     interface{}
+	zero     bool
+}
+
+// WithParallelism limits NextWg to at most n concurrent calls to fill, rather
+// than one per value in the cache.
+func WithParallelism(n int) Option {
+	return func(o *options) {
+		o.parallel = n
+	}
+}
+
+// WithPrefill fills a second buffer in the background once fewer than low
+// values remain, so that Next rarely has to wait on fill. The buffers are
+// swapped once all values have been withdrawn. If the background fill fails,
+// the next refill is done in the foreground instead.
+func WithPrefill(low int) Option {
+	return func(o *options) {
+		o.low = low
+	}
 }
 
-// NewDCache creates a new delayed cache.
-func NewDCache(size int, fill func() interface{}) (*DCache, error) {
+// WithWipe clears each slot of the cache as its value is withdrawn, and the
+// remaining values on Close, so values such as key material are not kept
+// around after being handed out. Slots are set to the zero value, and []byte
+// values are zeroed in place, with a copy returned instead.
+func WithWipe() Option {
+	return func(o *options) {
+		o.zero = true
+	}
+}
+
+// WithWipeFunc is like WithWipe, but clears slots with wipe, which is called
+// after the value has been copied out of the slot, and may be called again on
+// slots already cleared. The type of wipe must match the cache's value type.
+func WithWipeFunc[T any](wipe func(*T)) Option {
+	return func(o *options) {
+		o.wipe = wipe
+	}
+}
+
+// NewDCache creates a new delayed cache, filled one value at a time.
+func NewDCache[T any](size int, fill func() (T, error), opts ...Option) (*DCache[T], error) {
+	if fill == nil {
+		return nil, errors.New("dcache: fill is nil")
+	}
+
+	d, err := newDCache[T](size, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.fill = fill
+	d.batch = func(ctx context.Context, n int) ([]T, error) {
+		ret := make([]T, n)
+
+		for i := range ret {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			var err error
+
+			if ret[i], err = fill(); err != nil {
+				return nil, err
+			}
+		}
+
+		return ret, nil
+	}
+
+	return d, nil
+}
+
+// NewBatchDCache creates a new delayed cache, filled by a single call to fill
+// producing all n values of the cache.
+func NewBatchDCache[T any](size int, fill func(ctx context.Context, n int) ([]T, error), opts ...Option) (*DCache[T], error) {
+	if fill == nil {
+		return nil, errors.New("dcache: fill is nil")
+	}
+
+	d, err := newDCache[T](size, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.batch = fill
+
+	return d, nil
+}
+
+func newDCache[T any](size int, opts []Option) (*DCache[T], error) {
 	if size <= 0 {
 		return nil, errors.New("dcache: size <= 0")
-	} else if fill == nil {
-		return nil, errors.New("dcache: fill is nil")
 	}
 
-	return &DCache{
-		cache: make([]interface{}, size),
-		fill:  fill,
-		index: size - 1,
-		size:  size,
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.low < 0 || o.low > size {
+		return nil, errors.New("dcache: prefill low-water mark not in [0, size]")
+	} else if o.parallel < 0 {
+		return nil, errors.New("dcache: parallelism < 0")
+	}
+
+	var wipe func(*T)
+
+	if o.wipe != nil {
+		var ok bool
+
+		if wipe, ok = o.wipe.(func(*T)); !ok {
+			return nil, errors.New("dcache: wipe function does not match value type")
+		}
+	} else if o.zero {
+		wipe = zero[T]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &DCache[T]{
+		cache:  make([]T, size),
+		cancel: cancel,
+		ctx:    ctx,
+		index:  size - 1,
+		opts:   o,
+		size:   size,
+		wipe:   wipe,
 	}, nil
 }
 
-// Next retrieves the next value in the cache. Refilling is done consecutively.
-func (d *DCache) Next() interface{} {
+// Next retrieves the next value in the cache. Refilling is done consecutively,
+// or by a single call for a batch cache. If refilling fails, the error is
+// returned and the next call tries again.
+func (d *DCache[T]) Next() (T, error) {
+	return d.withdraw(d.fillBatch)
+}
+
+// NextWg retrieves the next value in the cache. Refilling is done concurrently,
+// see WithParallelism, or by a single call for a batch cache. If refilling
+// fails, no further calls to fill are started, the first error is returned,
+// and the next call tries again.
+func (d *DCache[T]) NextWg() (T, error) {
+	if d.fill == nil {
+		return d.Next()
+	}
+
+	return d.withdraw(d.fillWg)
+}
+
+// NextN retrieves the next n values in the cache, refilling consecutively as
+// needed, without letting other callers withdraw values in between. If
+// refilling fails, the values withdrawn so far are returned with the error.
+func (d *DCache[T]) NextN(n int) ([]T, error) {
+	if n < 0 {
+		return nil, errors.New("dcache: n < 0")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	ret := make([]T, 0, n)
+
+	for len(ret) < n {
+		if d.index == d.size-1 {
+			if err := d.refill(d.fillBatch); err != nil {
+				if d.ctx.Err() != nil {
+					err = ErrClosed
+				}
+
+				return ret, err
+			}
+		}
+
+		ret = append(ret, d.take())
+		d.startPrefill()
+	}
+
+	return ret, nil
+}
+
+// Chan streams values from the cache into the returned value channel until ctx
+// is done or Next fails. The value channel is then closed, after sending the
+// error which stopped the stream to the error channel.
+func (d *DCache[T]) Chan(ctx context.Context) (<-chan T, <-chan error) {
+	values := make(chan T)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(values)
+
+		for {
+			v, err := d.Next()
+
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			select {
+			case values <- v:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return values, errc
+}
+
+// tryNext withdraws the next value if one is ready without waiting on fill,
+// otherwise it starts filling the next buffer in the background.
+func (d *DCache[T]) tryNext() (T, bool) {
+	var zero T
+
 	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ctx.Err() != nil {
+		return zero, false
+	}
 
 	if d.index == d.size-1 {
-		for i := 0; i < d.size; i++ {
-			d.cache[i] = d.fill()
+		d.collect(false)
+
+		if d.next == nil {
+			d.fillNext()
+			return zero, false
 		}
+
+		d.cache, d.next = d.next, nil
 	}
 
-	ret := d.cache[d.index]
+	ret := d.take()
 
-	if d.index == 0 {
-		d.index = d.size - 1
-	} else {
-		d.index--
+	d.startPrefill()
+
+	return ret, true
+}
+
+// Close cancels refilling in progress and makes further use of the cache
+// return ErrClosed. Calls to fill already started are not interrupted, except
+// through the context given to a batch fill. With WithWipe, Close waits for a
+// refill in progress and clears the values remaining in the cache.
+func (d *DCache[T]) Close() {
+	d.cancel()
+
+	if d.wipe == nil {
+		return
 	}
 
-	d.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return ret
+	d.collect(true)
+	d.clear(d.cache)
+	d.clear(d.next)
+	d.next = nil
 }
 
-// NextWg retrieves the next value in the cache. Refilling is done concurrently.
-func (d *DCache) NextWg() interface{} {
+// withdraw takes the next value, refilling with fill if needed.
+func (d *DCache[T]) withdraw(fill func() ([]T, error)) (T, error) {
+	var zero T
+
 	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ctx.Err() != nil {
+		return zero, ErrClosed
+	}
+
+	if d.index == d.size-1 {
+		if err := d.refill(fill); err != nil {
+			if d.ctx.Err() != nil {
+				err = ErrClosed
+			}
+
+			return zero, err
+		}
+	}
+
+	ret := d.take()
+
+	d.startPrefill()
+
+	return ret, nil
+}
+
+// refill replaces the drained cache, with the prefilled buffer if there is
+// one. A background fill in progress is waited for rather than duplicated, so
+// fill is never called concurrently by the cache itself. Must be called with
+// the mutex held.
+func (d *DCache[T]) refill(fill func() ([]T, error)) error {
+	d.collect(true)
+
+	if d.next != nil {
+		d.cache, d.next = d.next, nil
+		return nil
+	}
+
+	ret, err := fill()
+
+	if err != nil {
+		d.clear(ret)
+		return err
+	}
+
+	d.cache = ret
+	return nil
+}
+
+// startPrefill starts filling the next buffer in the background once the
+// cache falls below the low-water mark. Must be called with the mutex held.
+func (d *DCache[T]) startPrefill() {
+	remaining := d.index + 1
 
 	if d.index == d.size-1 {
-		var wg sync.WaitGroup
-		wg.Add(d.size)
-
-		for i := 0; i < d.size; i++ {
-			go func(i int) {
-				d.cache[i] = d.fill()
-				wg.Done()
-			}(i)
+		// All values have been withdrawn.
+		remaining = 0
+	}
+
+	if d.opts.low == 0 || remaining >= d.opts.low {
+		return
+	}
+
+	d.fillNext()
+}
+
+// fillNext starts filling the next buffer in the background, unless it is
+// already filled or being filled. Must be called with the mutex held.
+func (d *DCache[T]) fillNext() {
+	if d.prefill != nil || d.next != nil {
+		return
+	}
+
+	// The result is handed over through the channel rather than under the
+	// mutex, so it can be waited for while holding the mutex.
+	c := make(chan []T, 1)
+	d.prefill = c
+
+	go func() {
+		ret, err := d.fillBatch()
+
+		if err != nil || d.ctx.Err() != nil {
+			d.clear(ret)
+			ret = nil
+		}
+
+		c <- ret
+	}()
+}
+
+// collect takes the result of the background fill as the next buffer, if it
+// has finished or when waiting for it. A failed fill leaves no next buffer.
+// Must be called with the mutex held.
+func (d *DCache[T]) collect(wait bool) {
+	if d.prefill == nil {
+		return
+	}
+
+	var ret []T
+
+	if wait {
+		ret = <-d.prefill
+	} else {
+		select {
+		case ret = <-d.prefill:
+		default:
+			return
 		}
+	}
+
+	d.prefill = nil
+
+	if ret != nil {
+		d.next = ret
+	}
+}
+
+func (d *DCache[T]) fillBatch() ([]T, error) {
+	ret, err := d.batch(d.ctx, d.size)
+
+	if err == nil && len(ret) != d.size {
+		err = fmt.Errorf("dcache: fill returned %d values, expected %d",
+			len(ret), d.size)
+	}
+
+	return ret, err
+}
+
+func (d *DCache[T]) fillWg() ([]T, error) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	workers := d.opts.parallel
+
+	if workers == 0 || workers > d.size {
+		workers = d.size
+	}
+
+	ret := make([]T, d.size)
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ferr error
+		next int64 = -1
+	)
+
+	wg.Add(workers)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				i := int(atomic.AddInt64(&next, 1))
+
+				if i >= d.size {
+					return
+				}
 
-		wg.Wait()
+				v, err := d.fill()
+
+				if err != nil {
+					once.Do(func() {
+						ferr = err
+						cancel()
+					})
+					return
+				}
+
+				ret[i] = v
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if ferr == nil {
+		ferr = d.ctx.Err()
 	}
 
+	return ret, ferr
+}
+
+// take withdraws the value at the index, clearing its slot if wiping. Must be
+// called with the mutex held.
+func (d *DCache[T]) take() T {
 	ret := d.cache[d.index]
 
+	if d.wipe != nil {
+		if b, ok := any(ret).([]byte); ok && d.opts.wipe == nil {
+			ret = any(append([]byte(nil), b...)).(T)
+		}
+
+		d.wipe(&d.cache[d.index])
+	}
+
 	if d.index == 0 {
 		d.index = d.size - 1
 	} else {
 		d.index--
 	}
 
-	d.mu.Unlock()
-
 	return ret
 }
+
+// clear wipes every slot of buf, if wiping.
+func (d *DCache[T]) clear(buf []T) {
+	if d.wipe == nil {
+		return
+	}
+
+	for i := range buf {
+		d.wipe(&buf[i])
+	}
+}
+
+// zero sets v to the zero value, zeroing []byte values in place first.
+func zero[T any](v *T) {
+	if b, ok := any(*v).([]byte); ok {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+
+	var z T
+	*v = z
+}
@@ -1,20 +1,26 @@
 package dcache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-// TestNonNil checks that the cache returns filled values, not nil (default
-// value of interface{}).
+// TestNonNil checks that the cache returns filled values, not the zero value.
 func TestNonNil(t *testing.T) {
 	const (
 		size = 10
 		reps = size*2 + 1
 	)
 
-	fill := func() interface{} {
-		return rand.Intn(3)
+	fill := func() (int, error) {
+		return rand.Intn(3) + 1, nil
 	}
 
 	d, err := NewDCache(size, fill)
@@ -24,17 +30,103 @@ func TestNonNil(t *testing.T) {
 	}
 
 	for i := 0; i < reps; i++ {
-		if d.Next() == nil {
-			t.Fatalf("%s at index %d\n", err, i)
+		if v, err := d.Next(); err != nil || v == 0 {
+			t.Fatalf("%v at index %d\n", err, i)
+		}
+
+		if v, err := d.NextWg(); err != nil || v == 0 {
+			t.Fatalf("%v at index %d\n", err, i)
 		}
 	}
 }
 
+// TestBatch checks that a batch cache is filled by a single call per ring.
+func TestBatch(t *testing.T) {
+	const size = 10
+
+	var calls int
+
+	fill := func(_ context.Context, n int) ([]int, error) {
+		calls++
+		ret := make([]int, n)
+		for i := range ret {
+			ret[i] = calls
+		}
+		return ret, nil
+	}
+
+	d, err := NewBatchDCache(size, fill)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3*size; i++ {
+		v, err := d.NextWg()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := i/size + 1; v != want {
+			t.Fatalf("expected %d got %d at index %d", want, v, i)
+		}
+	}
+
+	if calls != 3 {
+		t.Fatalf("expected 3 calls got %d", calls)
+	}
+}
+
+// TestError checks that fill errors are returned from Next, and that the next
+// call tries again.
+func TestError(t *testing.T) {
+	const size = 10
+
+	errFill := errors.New("fill failed")
+	fail := true
+
+	fill := func() (int, error) {
+		if fail {
+			return 0, errFill
+		}
+		return 1, nil
+	}
+
+	d, _ := NewDCache(size, fill)
+
+	if _, err := d.Next(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	if _, err := d.NextWg(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	fail = false
+
+	for i := 0; i < size; i++ {
+		if v, err := d.Next(); err != nil || v != 1 {
+			t.Fatalf("got %d, %v at index %d", v, err, i)
+		}
+	}
+
+	short := func(_ context.Context, n int) ([]int, error) {
+		return make([]int, n-1), nil
+	}
+
+	b, _ := NewBatchDCache(size, short)
+
+	if _, err := b.Next(); err == nil {
+		t.Fatal("short batch accepted")
+	}
+}
+
 func BenchmarkNext(b *testing.B) {
 	const size = 10
 
-	fill := func() interface{} {
-		return 3
+	fill := func() (int, error) {
+		return 3, nil
 	}
 
 	d, _ := NewDCache(size, fill)
@@ -42,7 +134,7 @@ func BenchmarkNext(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_ = d.Next()
+		_, _ = d.Next()
 	}
 }
 
@@ -50,8 +142,8 @@ func BenchmarkNext(b *testing.B) {
 func BenchmarkNextWg(b *testing.B) {
 	const size = 10
 
-	fill := func() interface{} {
-		return 3
+	fill := func() (int, error) {
+		return 3, nil
 	}
 
 	d, _ := NewDCache(size, fill)
@@ -59,6 +151,422 @@ func BenchmarkNextWg(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_ = d.NextWg()
+		_, _ = d.NextWg()
+	}
+}
+
+// TestPrefill checks that the next buffer is filled in the background once
+// below the low-water mark, and swapped in once drained.
+func TestPrefill(t *testing.T) {
+	const (
+		size = 10
+		low  = 3
+	)
+
+	var calls int
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	fill := func(_ context.Context, n int) ([]int, error) {
+		calls++
+		if calls == 2 {
+			started <- struct{}{}
+			<-release
+		}
+		ret := make([]int, n)
+		for i := range ret {
+			ret[i] = calls
+		}
+		return ret, nil
+	}
+
+	d, err := NewBatchDCache(size, fill, WithPrefill(low))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < size-low; i++ {
+		if v, _ := d.Next(); v != 1 {
+			t.Fatalf("expected %d got %d", 1, v)
+		}
+	}
+
+	// Below the low-water mark after the next withdrawal.
+	if v, _ := d.Next(); v != 1 {
+		t.Fatalf("expected %d got %d", 1, v)
+	}
+
+	<-started
+
+	// The remaining values are served while the prefill is in progress.
+	for i := 0; i < low-1; i++ {
+		if v, _ := d.Next(); v != 1 {
+			t.Fatalf("expected %d got %d", 1, v)
+		}
+	}
+
+	close(release)
+
+	for i := 0; i < size; i++ {
+		if v, _ := d.Next(); v != 2 {
+			t.Fatalf("expected %d got %d", 2, v)
+		}
+	}
+
+	if _, err = NewBatchDCache(size, fill, WithPrefill(size+1)); err == nil {
+		t.Fatal("low-water mark > size accepted")
+	}
+}
+
+// Test for race conditions when calling Next concurrently with prefilling, run
+// with the -race flag.
+func TestPrefillRace(t *testing.T) {
+	fill := func() (int, error) {
+		return 1, nil
+	}
+
+	d, _ := NewDCache(10, fill, WithPrefill(5))
+
+	reps := 1000
+
+	var wg sync.WaitGroup
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func() {
+			defer wg.Done()
+			if v, err := d.Next(); err != nil || v != 1 {
+				t.Errorf("got %d, %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestParallelism checks that NextWg never runs more fills at once than
+// allowed, and stops starting fills after the first error.
+func TestParallelism(t *testing.T) {
+	const (
+		size     = 100
+		parallel = 4
+	)
+
+	var running, peak, calls int64
+	fail := int64(-1)
+	errFill := errors.New("fill failed")
+
+	fill := func() (int, error) {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+
+		if atomic.AddInt64(&calls, 1) == atomic.LoadInt64(&fail) {
+			return 0, errFill
+		}
+
+		time.Sleep(time.Millisecond)
+		return 1, nil
+	}
+
+	d, err := NewDCache(size, fill, WithParallelism(parallel))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := d.NextWg(); err != nil || v != 1 {
+		t.Fatalf("got %d, %v", v, err)
+	}
+
+	if peak > parallel {
+		t.Fatalf("%d concurrent fills, expected at most %d", peak, parallel)
+	}
+
+	d, _ = NewDCache(size, fill, WithParallelism(parallel))
+	atomic.StoreInt64(&calls, 0)
+	atomic.StoreInt64(&fail, 10)
+
+	if _, err = d.NextWg(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	if n := atomic.LoadInt64(&calls); n >= size {
+		t.Fatalf("fills continued after error: %d calls", n)
+	}
+}
+
+// TestClose checks that closing cancels a refill in progress and rejects
+// further use.
+func TestClose(t *testing.T) {
+	started := make(chan struct{})
+
+	fill := func(ctx context.Context, n int) ([]int, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	d, _ := NewBatchDCache(10, fill)
+
+	done := make(chan error)
+	go func() {
+		_, err := d.Next()
+		done <- err
+	}()
+
+	<-started
+	d.Close()
+
+	if err := <-done; err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if _, err := d.NextWg(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+}
+
+// TestNextN checks that NextN withdraws values in order across refills.
+func TestNextN(t *testing.T) {
+	const size = 10
+
+	var n int
+
+	fill := func() (int, error) {
+		n++
+		return n, nil
+	}
+
+	d, _ := NewDCache(size, fill)
+
+	vals, err := d.NextN(25)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vals) != 25 {
+		t.Fatalf("expected 25 values got %d", len(vals))
+	}
+
+	// Values are withdrawn from the end of each ring.
+	for i, v := range vals {
+		if want := (i/size)*size + size - i%size; v != want {
+			t.Fatalf("expected %d got %d at index %d", want, v, i)
+		}
+	}
+
+	if vals, err = d.NextN(0); err != nil || len(vals) != 0 {
+		t.Fatalf("got %v, %v", vals, err)
+	}
+
+	if _, err = d.NextN(-1); err == nil {
+		t.Fatal("negative n accepted")
+	}
+}
+
+// TestChan checks that Chan streams values until its context is done.
+func TestChan(t *testing.T) {
+	fill := func() (int, error) {
+		return 1, nil
+	}
+
+	d, _ := NewDCache(10, fill)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	values, errc := d.Chan(ctx)
+
+	for i := 0; i < 25; i++ {
+		if v := <-values; v != 1 {
+			t.Fatalf("expected %d got %d", 1, v)
+		}
+	}
+
+	cancel()
+
+	for range values {
+	}
+
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	d.Close()
+	values, errc = d.Chan(context.Background())
+
+	for range values {
+	}
+
+	if err := <-errc; err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+}
+
+// TestWipe checks that withdrawn []byte values are zeroed in the cache but not
+// in the returned copy, and that Close zeroes the remaining values.
+func TestWipe(t *testing.T) {
+	const size = 4
+
+	var buf []byte
+
+	fill := func(_ context.Context, n int) ([][]byte, error) {
+		buf = bytes.Repeat([]byte{0xff}, 2*n)
+		ret := make([][]byte, n)
+		for i := range ret {
+			ret[i] = buf[2*i : 2*i+2]
+		}
+		return ret, nil
+	}
+
+	d, err := NewBatchDCache(size, fill, WithWipe())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := d.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(v, []byte{0xff, 0xff}) {
+		t.Fatalf("returned value wiped: %x", v)
+	}
+
+	if !bytes.Equal(buf[2*(size-1):], []byte{0, 0}) || d.cache[size-1] != nil {
+		t.Fatal("withdrawn slot not wiped")
+	}
+
+	d.Close()
+
+	if !bytes.Equal(buf, make([]byte, 2*size)) {
+		t.Fatalf("remaining values not wiped: %x", buf)
+	}
+
+	type key struct {
+		b []byte
+	}
+
+	var wiped int
+
+	wipe := func(k *key) {
+		wiped++
+		k.b = nil
+	}
+
+	fillKey := func() (key, error) {
+		return key{b: []byte{1}}, nil
+	}
+
+	k, _ := NewDCache(size, fillKey, WithWipeFunc(wipe))
+
+	if v, _ := k.Next(); v.b == nil || wiped != 1 {
+		t.Fatalf("got %v after %d wipes", v, wiped)
+	}
+
+	if _, err = NewDCache(size, fillKey, WithWipeFunc(func(*int) {})); err == nil {
+		t.Fatal("mismatched wipe function accepted")
+	}
+}
+
+// TestWipeUnique checks that no value is returned twice, or wiped before it is
+// returned, under concurrent withdrawal and refill.
+func TestWipeUnique(t *testing.T) {
+	var n int64
+
+	fill := func() (int64, error) {
+		return atomic.AddInt64(&n, 1), nil
+	}
+
+	d, _ := NewDCache(10, fill, WithWipe(), WithPrefill(5))
+
+	const reps = 1000
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func() {
+			defer wg.Done()
+			v, err := d.Next()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || v == 0 || seen[v] {
+				t.Errorf("got %d, %v", v, err)
+			}
+			seen[v] = true
+		}()
+	}
+	wg.Wait()
+}
+
+// TestNextNPrefill checks that NextN waits on a prefill in progress, keeping
+// the lock, rather than call fill concurrently.
+func TestNextNPrefill(t *testing.T) {
+	const size = 4
+
+	var calls, running, peak int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	fill := func(_ context.Context, n int) ([]int, error) {
+		r := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		if r > atomic.LoadInt64(&peak) {
+			atomic.StoreInt64(&peak, r)
+		}
+
+		c := atomic.AddInt64(&calls, 1)
+		if c == 2 {
+			close(started)
+			<-release
+		}
+		ret := make([]int, n)
+		for i := range ret {
+			ret[i] = int(c)
+		}
+		return ret, nil
+	}
+
+	d, _ := NewBatchDCache(size, fill, WithPrefill(size))
+
+	if _, err := d.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+
+	done := make(chan []int)
+
+	go func() {
+		vals, err := d.NextN(size + 1)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- vals
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	vals := <-done
+
+	if want := []int{1, 1, 1, 2, 2}; fmt.Sprint(vals) != fmt.Sprint(want) {
+		t.Fatalf("expected %v got %v", want, vals)
+	}
+
+	if peak != 1 {
+		t.Fatalf("%d concurrent fills", peak)
 	}
 }
@@ -0,0 +1,94 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Sharded is a delayed cache split into shards, each with its own ring buffer
+// and refills, to reduce lock contention between many concurrent callers.
+// Callers prefer a shard local to their P, and steal from other shards while
+// their own is refilled in the background.
+type Sharded[T any] struct {
+	hint   sync.Pool
+	next   uint32
+	shards []*DCache[T]
+}
+
+// NewSharded creates a new sharded delayed cache of n shards, each holding
+// size values filled one at a time. The options apply to each shard. The
+// shards refill independently, so fill may be called concurrently.
+func NewSharded[T any](n, size int, fill func() (T, error), opts ...Option) (*Sharded[T], error) {
+	return newSharded(n, func() (*DCache[T], error) {
+		return NewDCache(size, fill, opts...)
+	})
+}
+
+// NewBatchSharded creates a new sharded delayed cache of n shards, each
+// holding size values filled by a single call to fill.
+func NewBatchSharded[T any](n, size int, fill func(ctx context.Context, n int) ([]T, error), opts ...Option) (*Sharded[T], error) {
+	return newSharded(n, func() (*DCache[T], error) {
+		return NewBatchDCache(size, fill, opts...)
+	})
+}
+
+func newSharded[T any](n int, shard func() (*DCache[T], error)) (*Sharded[T], error) {
+	if n <= 0 {
+		return nil, errors.New("dcache: shards <= 0")
+	}
+
+	s := &Sharded[T]{
+		shards: make([]*DCache[T], n),
+	}
+
+	for i := range s.shards {
+		var err error
+
+		if s.shards[i], err = shard(); err != nil {
+			return nil, err
+		}
+	}
+
+	// sync.Pool keeps a per-P cache, so callers on the same P mostly get
+	// the same shard.
+	s.hint.New = func() interface{} {
+		i := int(atomic.AddUint32(&s.next, 1)) % n
+		return &i
+	}
+
+	return s, nil
+}
+
+// Next retrieves the next value from the local shard, or from another shard
+// while the local one is refilled. If all shards are empty, it waits for the
+// local shard to refill, as with DCache.Next.
+func (s *Sharded[T]) Next() (T, error) {
+	hint := s.hint.Get().(*int)
+	home := *hint
+
+	defer s.hint.Put(hint)
+
+	for i := range s.shards {
+		j := (home + i) % len(s.shards)
+
+		if v, ok := s.shards[j].tryNext(); ok {
+			if i != 0 {
+				// Move to a shard which still has values.
+				*hint = j
+			}
+
+			return v, nil
+		}
+	}
+
+	return s.shards[home].Next()
+}
+
+// Close closes every shard, see DCache.Close.
+func (s *Sharded[T]) Close() {
+	for _, d := range s.shards {
+		d.Close()
+	}
+}
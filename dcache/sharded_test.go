@@ -0,0 +1,113 @@
+package dcache
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSharded checks that no value is returned twice across shards, and that
+// errors and closing are reported.
+func TestSharded(t *testing.T) {
+	const (
+		shards = 4
+		size   = 10
+		reps   = 1000
+	)
+
+	var n int64
+
+	fill := func() (int64, error) {
+		return atomic.AddInt64(&n, 1), nil
+	}
+
+	s, err := NewSharded(shards, size, fill)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func() {
+			defer wg.Done()
+			v, err := s.Next()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || v == 0 || seen[v] {
+				t.Errorf("got %d, %v", v, err)
+			}
+			seen[v] = true
+		}()
+	}
+	wg.Wait()
+
+	s.Close()
+
+	if _, err = s.Next(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	errFill := errors.New("fill failed")
+
+	fail := func() (int64, error) {
+		return 0, errFill
+	}
+
+	s, _ = NewSharded(shards, size, fail)
+
+	if _, err = s.Next(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	if _, err = NewSharded(0, size, fill); err == nil {
+		t.Fatal("zero shards accepted")
+	}
+}
+
+func BenchmarkContention(b *testing.B) {
+	const size = 1000
+
+	fill := func() (int, error) {
+		return 3, nil
+	}
+
+	b.Run("DCache", func(b *testing.B) {
+		d, _ := NewDCache(size, fill)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = d.Next()
+			}
+		})
+	})
+
+	b.Run("DCachePrefill", func(b *testing.B) {
+		d, _ := NewDCache(size, fill, WithPrefill(size/2))
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = d.Next()
+			}
+		})
+	})
+
+	b.Run("Sharded", func(b *testing.B) {
+		s, _ := NewSharded(runtime.GOMAXPROCS(0), size, fill,
+			WithPrefill(size/2))
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = s.Next()
+			}
+		})
+	})
+}
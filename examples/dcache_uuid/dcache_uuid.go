@@ -10,7 +10,7 @@ import (
 	"github.com/esote/util/uuid"
 )
 
-var cacheUUID *dcache.DCache
+var cacheUUID *dcache.DCache[[]byte]
 
 func srvUUIDs(w http.ResponseWriter, r *http.Request) {
 	count := 10
@@ -21,20 +21,22 @@ func srvUUIDs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	for i := 0; i < count; i++ {
-		_, _ = fmt.Fprintf(w, "%x\n", cacheUUID.NextWg().([]byte))
+	uuids, err := cacheUUID.NextN(count)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-}
 
-func main() {
-	fillUUID := func() interface{} {
-		ret, _ := uuid.NewUUID()
-		return ret
+	for _, u := range uuids {
+		_, _ = fmt.Fprintf(w, "%x\n", u)
 	}
+}
 
+func main() {
 	var err error
 
-	cacheUUID, err = dcache.NewDCache(1000, fillUUID)
+	cacheUUID, err = dcache.NewDCache(1000, uuid.NewUUID)
 
 	if err != nil {
 		log.Fatal(err)
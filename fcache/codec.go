@@ -0,0 +1,356 @@
+package fcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Codec transforms content on its way into and out of the cache file, for
+// example to compress or encrypt it.
+type Codec interface {
+	// Encode returns a writer which encodes content into w. Closing the
+	// writer flushes the encoded content, but does not close w.
+	Encode(w io.Writer) (io.WriteCloser, error)
+
+	// Decode returns a reader which decodes content from r.
+	Decode(r io.Reader) (io.Reader, error)
+}
+
+// WithCodecs encodes the content with each codec in order when writing the
+// cache file, and decodes it in reverse order when reading. To both compress
+// and encrypt, compress first. Content which fails to decode, such as when an
+// encryption key was changed, is refilled rather than served.
+func WithCodecs(codecs ...Codec) Option {
+	return func(o *options) {
+		o.codecs = codecs
+	}
+}
+
+// encode wraps w with the codecs, returning the writer for content and a
+// function to flush it.
+func encode(w io.Writer, codecs []Codec) (io.Writer, func() error, error) {
+	var wcs []io.WriteCloser
+
+	for i := len(codecs) - 1; i >= 0; i-- {
+		wc, err := codecs[i].Encode(w)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		wcs = append(wcs, wc)
+		w = wc
+	}
+
+	flush := func() error {
+		for i := len(wcs) - 1; i >= 0; i-- {
+			if err := wcs[i].Close(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return w, flush, nil
+}
+
+// decode wraps r with the codecs, returning the reader for content.
+func decode(r io.Reader, codecs []Codec) (io.Reader, error) {
+	for i := len(codecs) - 1; i >= 0; i-- {
+		var err error
+
+		if r, err = codecs[i].Decode(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// decodeAll decodes the content of a cache file held in memory. Any decoding
+// error means the content is invalid.
+func decodeAll(data []byte, codecs []Codec) ([]byte, error) {
+	if len(codecs) == 0 {
+		return data, nil
+	}
+
+	r, err := decode(bytes.NewReader(data), codecs)
+
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return nil, ErrInvalid
+	}
+
+	return data, nil
+}
+
+type gzipCodec int
+
+// Gzip compresses content with gzip at the given level, see compress/gzip.
+func Gzip(level int) (Codec, error) {
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+
+	return gzipCodec(level), nil
+}
+
+func (c gzipCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, int(c))
+}
+
+func (c gzipCodec) Decode(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type flateCodec int
+
+// Flate compresses content with DEFLATE at the given level, see
+// compress/flate. Unlike Gzip, the content has no checksum of its own.
+func Flate(level int) (Codec, error) {
+	if _, err := flate.NewWriter(nil, level); err != nil {
+		return nil, err
+	}
+
+	return flateCodec(level), nil
+}
+
+func (c flateCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, int(c))
+}
+
+func (c flateCodec) Decode(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+// AES-GCM content is split into chunks, each sealed separately so content
+// larger than memory can be streamed. Each file starts with a random salt,
+// from which a key for the file is derived with HKDF-SHA256, like Tink's
+// streaming AEAD, so nonces only need to be unique within a file. Each chunk's
+// nonce is a random prefix chosen per file, followed by the chunk index and
+// whether it is the last chunk, so chunks cannot be reordered, dropped, or
+// truncated unnoticed.
+const (
+	gcmChunk  = 64 * 1024
+	gcmPrefix = 7
+	gcmSalt   = 32
+	gcmHeader = gcmSalt + gcmPrefix
+)
+
+var gcmInfo = []byte("fcache aes-gcm")
+
+type gcmCodec struct {
+	key []byte
+}
+
+// AESGCM encrypts and authenticates content with AES-GCM. The key must be 16,
+// 24, or 32 bytes long to select AES-128, AES-192, or AES-256. Each file is
+// encrypted with its own key derived from key.
+func AESGCM(key []byte) (Codec, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	return &gcmCodec{key: append([]byte(nil), key...)}, nil
+}
+
+// aead returns the AEAD for the file with the given salt.
+func (c *gcmCodec) aead(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(c.key, salt, gcmInfo, len(c.key)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (c *gcmCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, gcmHeader)
+
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+
+	aead, err := c.aead(header[:gcmSalt])
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &gcmStream{
+		aead:  aead,
+		buf:   make([]byte, 0, gcmChunk+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+		w:     w,
+	}
+
+	copy(s.nonce, header[gcmSalt:])
+
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Decode authenticates the first chunk before returning, so content which
+// fails to authenticate is detected when opened rather than partway through.
+func (c *gcmCodec) Decode(r io.Reader) (io.Reader, error) {
+	header := make([]byte, gcmHeader)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalid
+	}
+
+	aead, err := c.aead(header[:gcmSalt])
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &gcmStream{
+		aead:  aead,
+		buf:   make([]byte, gcmChunk+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+		r:     r,
+	}
+
+	copy(s.nonce, header[gcmSalt:])
+
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// hkdf derives an n-byte key from secret and salt with HKDF-SHA256, see RFC
+// 5869. Only a single block of output is needed, so n must be at most 32.
+func hkdf(secret, salt, info []byte, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	_, _ = extract.Write(secret)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	_, _ = expand.Write(info)
+	_, _ = expand.Write([]byte{1})
+
+	return expand.Sum(nil)[:n]
+}
+
+// gcmStream seals chunks written to w, or opens chunks read from r.
+type gcmStream struct {
+	aead  cipher.AEAD
+	buf   []byte
+	done  bool
+	index uint32
+	nonce []byte
+	plain []byte
+	r     io.Reader
+	w     io.Writer
+}
+
+func (s *gcmStream) setNonce(last bool) {
+	binary.BigEndian.PutUint32(s.nonce[gcmPrefix:], s.index)
+
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+
+	s.index++
+}
+
+func (s *gcmStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := copy(s.buf[len(s.buf):gcmChunk], p)
+		s.buf = s.buf[:len(s.buf)+m]
+		p = p[m:]
+		n += m
+
+		// A full chunk is only sealed once more content follows, as the
+		// last chunk must be shorter than a full one.
+		if len(s.buf) == gcmChunk && len(p) > 0 {
+			if err = s.seal(false); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Close seals the last chunk, which may be empty.
+func (s *gcmStream) Close() error {
+	if len(s.buf) == gcmChunk {
+		if err := s.seal(false); err != nil {
+			return err
+		}
+	}
+
+	return s.seal(true)
+}
+
+func (s *gcmStream) seal(last bool) error {
+	s.setNonce(last)
+	out := s.aead.Seal(s.buf[:0], s.nonce, s.buf, nil)
+	s.buf = s.buf[:0]
+
+	_, err := s.w.Write(out)
+	return err
+}
+
+func (s *gcmStream) Read(p []byte) (n int, err error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		if err = s.open(); err != nil {
+			return
+		}
+	}
+
+	n = copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return
+}
+
+// open reads and authenticates the next chunk. Only the last chunk is shorter
+// than a full one.
+func (s *gcmStream) open() error {
+	m, err := io.ReadFull(s.r, s.buf)
+
+	switch {
+	case err == nil:
+		s.setNonce(false)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		s.setNonce(true)
+		s.done = true
+	case errors.Is(err, io.EOF):
+		// The last chunk is missing.
+		return ErrInvalid
+	default:
+		return err
+	}
+
+	if s.plain, err = s.aead.Open(s.buf[:0], s.nonce, s.buf[:m], nil); err != nil {
+		return ErrInvalid
+	}
+
+	return nil
+}
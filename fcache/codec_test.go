@@ -0,0 +1,274 @@
+package fcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that content round trips through each codec, read whole or streamed.
+func TestCodecs(t *testing.T) {
+	gz, err := Gzip(gzip.BestSpeed)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fl, err := Flate(-1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm, err := AESGCM(bytes.Repeat([]byte{1}, 32))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	json := bytes.Repeat([]byte(`{"customer":"secret"}`), 10000)
+
+	tests := []struct {
+		name   string
+		codecs []Codec
+		data   []byte
+	}{
+		{"none", nil, json},
+		{"gzip", []Codec{gz}, json},
+		{"flate", []Codec{fl}, json},
+		{"aes-gcm", []Codec{gcm}, json},
+		{"gzip+aes-gcm", []Codec{gz, gcm}, json},
+		{"flate+aes-gcm", []Codec{fl, gcm}, json},
+		{"aes-gcm+gzip", []Codec{gcm, gz}, json},
+		{"aes-gcm empty", []Codec{gcm}, nil},
+		{"aes-gcm exact chunks", []Codec{gcm}, bytes.Repeat([]byte("x"), 2*gcmChunk)},
+	}
+
+	for _, test := range tests {
+		name, codecs, data := test.name, test.codecs, test.data
+
+		fill := func() ([]byte, error) {
+			return data, nil
+		}
+
+		path := filepath.Join(t.TempDir(), "data.fcache")
+		f, err := NewFCache(time.Hour, fill, WithPath(path),
+			WithCodecs(codecs...))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := f.Next()
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%s: content changed", name)
+		}
+
+		disk, _ := ioutil.ReadFile(path)
+
+		if len(codecs) > 0 && len(data) > 0 && bytes.Contains(disk, data[:20]) {
+			t.Fatalf("%s: content not encoded", name)
+		}
+
+		r, err := f.Open()
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if b, err = ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+			t.Fatalf("%s: streamed content changed: %v", name, err)
+		}
+
+		if len(data) > 0 {
+			if _, err = r.Seek(10, io.SeekStart); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			if b, err = ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data[10:]) {
+				t.Fatalf("%s: seeked content changed: %v", name, err)
+			}
+		}
+
+		_ = r.Close()
+		_ = f.Close()
+	}
+}
+
+// Test that content which fails to authenticate, such as after a key change,
+// is treated as a miss and refilled.
+func TestCodecKeyChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.fcache")
+
+	var fills int
+
+	fill := func() ([]byte, error) {
+		fills++
+		return []byte("secret"), nil
+	}
+
+	key1, _ := AESGCM(bytes.Repeat([]byte{1}, 16))
+	key2, _ := AESGCM(bytes.Repeat([]byte{2}, 16))
+
+	f1, _ := NewFCache(time.Hour, fill, WithPath(path), WithCodecs(key1))
+
+	if _, err := f1.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, _ := NewFCache(time.Hour, fill, WithPath(path), WithCodecs(key2))
+
+	b, err := f2.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "secret" || fills != 2 {
+		t.Fatalf("got %q after %d fills", b, fills)
+	}
+
+	// Open also refills rather than return a reader which fails.
+	f3, _ := NewFCache(time.Hour, fill, WithPath(path), WithCodecs(key1))
+
+	r, err := f3.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if b, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "secret" || fills != 3 {
+		t.Fatalf("got %q after %d fills", b, fills)
+	}
+}
+
+// Test that each encoding uses its own salt and derived key, so nonces cannot
+// repeat across files.
+func TestGCMSubkeys(t *testing.T) {
+	c, _ := AESGCM(bytes.Repeat([]byte{1}, 32))
+	data := []byte("the same content")
+
+	encode := func() []byte {
+		var buf bytes.Buffer
+
+		w, _ := c.Encode(&buf)
+		_, _ = w.Write(data)
+		_ = w.Close()
+
+		return buf.Bytes()
+	}
+
+	enc1, enc2 := encode(), encode()
+	salt1, salt2 := enc1[:gcmSalt], enc2[:gcmSalt]
+
+	key := c.(*gcmCodec).key
+
+	if bytes.Equal(salt1, salt2) ||
+		bytes.Equal(hkdf(key, salt1, gcmInfo, 32), hkdf(key, salt2, gcmInfo, 32)) {
+		t.Fatal("subkeys repeated")
+	}
+
+	if bytes.Equal(enc1[gcmHeader:], enc2[gcmHeader:]) {
+		t.Fatal("ciphertext repeated")
+	}
+
+	// RFC 5869 test case 1, truncated to one block.
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf")
+
+	if !bytes.Equal(hkdf(ikm, salt, info, 32), want) {
+		t.Fatal("hkdf mismatch")
+	}
+}
+
+// Test that dropped AES-GCM chunks are detected.
+func TestGCMTruncate(t *testing.T) {
+	c, _ := AESGCM(bytes.Repeat([]byte{1}, 16))
+	data := bytes.Repeat([]byte("x"), 3*gcmChunk+10)
+
+	var buf bytes.Buffer
+
+	w, _ := c.Encode(&buf)
+	_, _ = w.Write(data)
+	_ = w.Close()
+
+	enc := buf.Bytes()
+	full := gcmChunk + 16
+
+	for _, n := range []int{gcmHeader + full, gcmHeader + 3*full, len(enc) - 1} {
+		r, err := c.Decode(bytes.NewReader(enc[:n]))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ioutil.ReadAll(r); err != ErrInvalid {
+			t.Fatalf("truncated to %d: expected %v got %v", n,
+				ErrInvalid, err)
+		}
+	}
+
+	r, _ := c.Decode(bytes.NewReader(enc))
+
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("content changed: %v", err)
+	}
+}
+
+// Test that reading through the end of encoded content verifies the checksum,
+// even for decoders which stop short of the end.
+func TestCodecChecksum(t *testing.T) {
+	gz, _ := Gzip(-1)
+	fl, _ := Flate(-1)
+
+	fill := func() ([]byte, error) {
+		return bytes.Repeat([]byte("data"), 100), nil
+	}
+
+	for _, c := range []Codec{gz, fl} {
+		path := filepath.Join(t.TempDir(), "data.fcache")
+		f, _ := NewFCache(time.Hour, fill, WithPath(path), WithCodecs(c))
+
+		if _, err := f.Next(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := ioutil.ReadFile(path)
+
+		for i := 24; i < headerLen; i++ {
+			b[i] ^= 0xff
+		}
+
+		_ = ioutil.WriteFile(path, b, 0600)
+
+		r, err := f.Open()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ioutil.ReadAll(r); err != ErrInvalid {
+			t.Fatalf("%T: expected %v got %v", c, ErrInvalid, err)
+		}
+
+		_ = r.Close()
+	}
+}
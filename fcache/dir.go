@@ -0,0 +1,436 @@
+package fcache
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esote/util/splay"
+)
+
+// Dir is a keyed file cache. Each value is stored in its own cache file within
+// a splayed directory and refreshes only after a certain duration. When the
+// cache files grow beyond a byte budget, the least recently used values are
+// evicted, or the least frequently used with WithLFU.
+//
+// The index is rebuilt from the directory when the cache is created, so values
+// survive restarts. Dir ignores WithPath and WithShared.
+type Dir struct {
+	budget  int64
+	dir     string
+	dur     time.Duration
+	entries map[string]*dirEntry
+	fill    func(string) ([]byte, error)
+	heap    dirHeap
+	mu      sync.Mutex
+	opts    options
+	seq     uint64
+	size    int64
+	splay   *splay.Splay
+}
+
+type dirEntry struct {
+	call    *dirCall
+	deleted bool
+	hits    uint64
+	index   int
+	last    time.Time
+	name    string
+	size    int64
+	used    uint64
+}
+
+// dirCall is an in-flight fill, shared by all callers waiting on the same key.
+type dirCall struct {
+	data []byte
+	done chan struct{}
+	err  error
+}
+
+// Cache file names are hex-encoded SHA-256 hashes of the keys, splayed like Git
+// objects.
+const dirCutoff = 2
+
+// WithLFU makes Dir evict the least frequently used values rather than the
+// least recently used. Ties are broken by recency. Use counts are not
+// persisted, so start from zero after a restart.
+func WithLFU() Option {
+	return func(o *options) {
+		o.lfu = true
+	}
+}
+
+// NewDir creates a new keyed file cache in dir, keeping the total size of its
+// cache files within budget bytes. Fill is called with the key being filled.
+func NewDir(dir string, dur time.Duration, budget int64, fill func(key string) ([]byte, error), opts ...Option) (*Dir, error) {
+	if dur <= 0 {
+		return nil, errors.New("fcache: duration <= 0")
+	} else if budget <= 0 {
+		return nil, errors.New("fcache: budget <= 0")
+	} else if fill == nil {
+		return nil, errors.New("fcache: fill is nil")
+	}
+
+	s, err := splay.NewSplay(dir, dirCutoff)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dir{
+		budget:  budget,
+		dir:     filepath.Clean(dir),
+		dur:     dur,
+		entries: make(map[string]*dirEntry),
+		fill:    fill,
+		opts:    newOptions(opts),
+		splay:   s,
+	}
+
+	d.heap.lfu = d.opts.lfu
+
+	if err = d.load(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Get retrieves the value for key, filling it if it is missing or expired. If
+// a fill for key is already in progress, Get waits for its result instead of
+// starting another. If fill returns an error, it is returned and the previous
+// content kept.
+func (d *Dir) Get(key string) ([]byte, error) {
+	name := dirName(key)
+	path, err := d.splay.Path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.lookup(name) {
+		_, data, err := readFile(path, d.opts.codecs)
+
+		// A file which is invalid, or was evicted since the lookup,
+		// is refilled.
+		if err != ErrInvalid && !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+
+	return d.refresh(key, name, path)
+}
+
+// Delete removes the value for key from the cache. A fill in progress for key
+// still completes, but its result is not stored.
+func (d *Dir) Delete(key string) error {
+	name := dirName(key)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[name]
+
+	if !ok {
+		return nil
+	}
+
+	if e.index < 0 {
+		// Not stored yet, only being filled.
+		if e.call != nil {
+			e.deleted = true
+		}
+
+		return nil
+	}
+
+	return d.remove(e)
+}
+
+// Size returns the total size of the cache files in bytes.
+func (d *Dir) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.size
+}
+
+// lookup reports whether name is stored and fresh, marking it as used.
+func (d *Dir) lookup(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.entries[name]
+
+	if !ok || e.index < 0 ||
+		d.opts.clock.Now().UTC().Sub(e.last) > d.dur {
+		return false
+	}
+
+	d.touch(e)
+	return true
+}
+
+// refresh fills the value for key, stored as name at path.
+func (d *Dir) refresh(key, name, path string) ([]byte, error) {
+	d.mu.Lock()
+
+	e, ok := d.entries[name]
+
+	if !ok {
+		e = &dirEntry{
+			index: -1,
+			name:  name,
+		}
+		d.entries[name] = e
+	}
+
+	if c := e.call; c != nil {
+		d.mu.Unlock()
+		<-c.done
+		return c.data, c.err
+	}
+
+	c := &dirCall{done: make(chan struct{})}
+	e.call = c
+
+	d.mu.Unlock()
+
+	now := d.opts.clock.Now().UTC()
+
+	var size int64
+
+	c.data, c.err = d.fill(key)
+
+	if c.err == nil {
+		size, c.err = d.write(path, now, c.data)
+	}
+
+	d.mu.Lock()
+
+	e.call = nil
+
+	if e.deleted {
+		// Deleted or evicted while filling, so the file just written
+		// is removed.
+		e.deleted = false
+
+		if c.err == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				c.err = err
+			}
+		}
+
+		if e.index < 0 {
+			delete(d.entries, name)
+		}
+	} else if c.err == nil {
+		if e.index >= 0 {
+			d.size -= e.size
+		}
+
+		d.size += size
+		e.last = now
+		e.size = size
+		d.touch(e)
+
+		if err := d.evict(); err != nil {
+			c.err = err
+		}
+	} else if e.index < 0 {
+		delete(d.entries, name)
+	}
+
+	d.mu.Unlock()
+
+	close(c.done)
+
+	return c.data, c.err
+}
+
+// write atomically writes the cache file at path, returning its size.
+func (d *Dir) write(path string, now time.Time, data []byte) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+
+	fill := func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+
+	return writeFile(path, now, fill, &d.opts)
+}
+
+// touch marks e as used, adding it to the heap if needed. Must be called with
+// the mutex held.
+func (d *Dir) touch(e *dirEntry) {
+	d.seq++
+	e.used = d.seq
+	e.hits++
+
+	if e.index < 0 {
+		heap.Push(&d.heap, e)
+	} else {
+		heap.Fix(&d.heap, e.index)
+	}
+}
+
+// evict removes values until the cache fits its budget. Must be called with
+// the mutex held.
+func (d *Dir) evict() error {
+	for d.size > d.budget && d.heap.Len() > 0 {
+		if err := d.remove(d.heap.entries[0]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the cache file of e. A fill in progress for e is marked so
+// its result is not stored. Must be called with the mutex held.
+func (d *Dir) remove(e *dirEntry) error {
+	heap.Remove(&d.heap, e.index)
+	d.size -= e.size
+
+	if e.call != nil {
+		e.deleted = true
+	} else {
+		delete(d.entries, e.name)
+	}
+
+	if err := d.splay.Remove(e.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// load rebuilds the index from the directory. Leftover temporary files and
+// invalid cache files are removed. Files are ordered for eviction by their
+// modification time.
+func (d *Dir) load() error {
+	type file struct {
+		e   *dirEntry
+		mod time.Time
+	}
+
+	var files []file
+
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		if base := fi.Name(); strings.HasPrefix(base, ".") &&
+			strings.HasSuffix(base, ".tmp") {
+			return os.Remove(path)
+		}
+
+		name := strings.Replace(rel, string(filepath.Separator), "", 1)
+
+		if len(name) != 2*sha256.Size || filepath.Dir(rel) != name[:dirCutoff] {
+			// Not a cache file.
+			return nil
+		}
+
+		h, err := readHeader(path)
+
+		if err == ErrInvalid {
+			return d.splay.Remove(name)
+		} else if err != nil {
+			return err
+		}
+
+		files = append(files, file{
+			e: &dirEntry{
+				index: -1,
+				last:  h.last,
+				name:  name,
+				size:  fi.Size(),
+			},
+			mod: fi.ModTime(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mod.Before(files[j].mod)
+	})
+
+	for _, f := range files {
+		d.seq++
+		f.e.used = d.seq
+		d.entries[f.e.name] = f.e
+		d.size += f.e.size
+		heap.Push(&d.heap, f.e)
+	}
+
+	return d.evict()
+}
+
+func dirName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// dirHeap orders entries by eviction priority.
+type dirHeap struct {
+	entries []*dirEntry
+	lfu     bool
+}
+
+func (h *dirHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *dirHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+
+	if h.lfu && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+
+	return a.used < b.used
+}
+
+func (h *dirHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *dirHeap) Push(x interface{}) {
+	e := x.(*dirEntry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *dirHeap) Pop() interface{} {
+	n := len(h.entries) - 1
+	e := h.entries[n]
+	h.entries[n] = nil
+	h.entries = h.entries[:n]
+	e.index = -1
+	return e
+}
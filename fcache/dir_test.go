@@ -0,0 +1,267 @@
+package fcache
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esote/util/clock"
+)
+
+// Test fill on miss, expiry, and reuse of the content after a restart.
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	dur := time.Minute
+	clk := clock.NewFake(time.Now())
+	errFill := errors.New("fill failed")
+
+	fills := make(map[string]int)
+	fail := false
+
+	fill := func(key string) ([]byte, error) {
+		if fail {
+			return nil, errFill
+		}
+		fills[key]++
+		return []byte(key + string(rune('0'+fills[key]))), nil
+	}
+
+	d, err := NewDir(dir, dur, 1<<20, fill, WithClock(clk))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(d *Dir, key, want string) {
+		t.Helper()
+
+		b, err := d.Get(key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != want {
+			t.Fatalf("expected %s got %s", want, b)
+		}
+	}
+
+	get(d, "a", "a1")
+	get(d, "b", "b1")
+	get(d, "a", "a1")
+
+	if want := 2 * (headerLen + 2); d.Size() != int64(want) {
+		t.Fatalf("expected size %d got %d", want, d.Size())
+	}
+
+	// Simulate a restart, with a leftover temporary file.
+	tmp := filepath.Join(dir, "ab", ".x.fcache.123.tmp")
+	_ = os.MkdirAll(filepath.Dir(tmp), 0700)
+	_ = ioutil.WriteFile(tmp, []byte("partial"), 0600)
+
+	d, err = NewDir(dir, dur, 1<<20, fill, WithClock(clk))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("temporary file not removed")
+	}
+
+	get(d, "a", "a1")
+	get(d, "b", "b1")
+
+	clk.Advance(2 * dur)
+
+	fail = true
+
+	if _, err = d.Get("a"); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	fail = false
+
+	get(d, "a", "a2")
+
+	if err = d.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	get(d, "a", "a3")
+}
+
+// Test that the byte budget is enforced by LRU or LFU eviction.
+func TestDirEvict(t *testing.T) {
+	const size = headerLen + 10
+
+	fill := func(key string) ([]byte, error) {
+		return bytes.Repeat([]byte(key), 10), nil
+	}
+
+	for _, lfu := range []bool{false, true} {
+		var opts []Option
+
+		if lfu {
+			opts = append(opts, WithLFU())
+		}
+
+		d, err := NewDir(t.TempDir(), time.Hour, 3*size, fill, opts...)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a is used most frequently, b most recently.
+		for _, key := range []string{"a", "a", "a", "c", "b"} {
+			if _, err = d.Get(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, _ = d.Get("d")
+
+		if d.Size() != 3*size {
+			t.Fatalf("expected size %d got %d", 3*size, d.Size())
+		}
+
+		// LRU evicts a, LFU evicts c.
+		evicted := "a"
+		if lfu {
+			evicted = "c"
+		}
+
+		for _, key := range []string{"a", "b", "c", "d"} {
+			path, _ := d.splay.Path(dirName(key))
+			_, err = os.Stat(path)
+
+			if (key == evicted) != os.IsNotExist(err) {
+				t.Fatalf("lfu %t: unexpected eviction of %s: %v",
+					lfu, key, err)
+			}
+		}
+	}
+}
+
+// Test that a value deleted while it is being filled is not stored.
+func TestDirDeleteFill(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var fills int
+
+	fill := func(key string) ([]byte, error) {
+		fills++
+		if fills == 1 {
+			close(started)
+			<-release
+		}
+		return []byte(key), nil
+	}
+
+	d, err := NewDir(t.TempDir(), time.Hour, 1<<20, fill)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := d.Get("a")
+		done <- err
+	}()
+
+	<-started
+
+	if err = d.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := d.splay.Path(dirName("a"))
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("deleted value stored")
+	}
+
+	if d.Size() != 0 {
+		t.Fatalf("expected size 0 got %d", d.Size())
+	}
+
+	if _, err = d.Get("a"); err != nil || fills != 2 {
+		t.Fatalf("expected refill, got %d fills: %v", fills, err)
+	}
+}
+
+// Test that a value evicted while it is being refilled is not stored, so the
+// size only counts files which exist.
+func TestDirEvictFill(t *testing.T) {
+	const size = headerLen + 1
+
+	clk := clock.NewFake(time.Now())
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var fills int
+
+	fill := func(key string) ([]byte, error) {
+		fills++
+		if key == "a" && fills > 1 {
+			close(started)
+			<-release
+		}
+		return []byte(key), nil
+	}
+
+	d, err := NewDir(t.TempDir(), time.Minute, size, fill, WithClock(clk))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(2 * time.Minute)
+
+	done := make(chan error)
+
+	go func() {
+		_, err := d.Get("a")
+		done <- err
+	}()
+
+	<-started
+
+	// Evicts a, whose refill is in progress.
+	if _, err = d.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	path, _ := d.splay.Path(dirName("a"))
+
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("evicted value stored")
+	}
+
+	if d.Size() != size {
+		t.Fatalf("expected size %d got %d", size, d.Size())
+	}
+}
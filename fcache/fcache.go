@@ -3,35 +3,151 @@ package fcache
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/esote/util/clock"
 )
 
 // FCache (file cache) is a cache which refreshes only after a certain duration.
 //
+// Readers do not wait on each other, nor on a refresh when there is previous
+// content to serve: a single refresher fills a new generation of the cache
+// file and atomically renames it into place, while readers keep using the
+// generation they opened. An old generation is removed by the file system once
+// its last reader closes it.
+//
 // This is the "file" version of TCache.
 type FCache struct {
-	dur  time.Duration
-	fill func() []byte
+	closed atomic.Bool
+	dur    time.Duration
+	fill   func(io.Writer) error
+	gen    atomic.Pointer[generation]
+	mu     sync.Mutex
+	name   string
+	opts   options
+}
+
+// ErrClosed is returned when using a closed cache.
+var ErrClosed = errors.New("fcache: cache closed")
+
+// generation is a published fill of the cache file.
+type generation struct {
 	last time.Time
-	mu   sync.Mutex
-	name string
 }
 
-// NewFCache creates a new file cache.
-func NewFCache(dur time.Duration, fill func() []byte) (*FCache, error) {
+// Option configures a file cache.
+type Option func(*options)
+
+type options struct {
+	clock   clock.Clock
+	codecs  []Codec
+	lfu     bool
+	path    string
+	shared  bool
+	syncDir bool
+}
+
+// WithClock sets the clock used to tell time, by default clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithPath binds the cache to the file at path rather than a new temporary
+// file. If the file was filled within the duration, for example by a previous
+// process, its content is reused rather than refilled.
+func WithPath(path string) Option {
+	return func(o *options) {
+		o.path = path
+	}
+}
+
+// WithShared lets several processes share the cache file set by WithPath. A
+// lock file beside the cache file ensures only one process refreshes it when
+// expired, while the others read the previous content, or wait if there is
+// none. Content refreshed by another process is picked up rather than
+// refilled. Only supported on Unix systems.
+func WithShared() Option {
+	return func(o *options) {
+		o.shared = true
+	}
+}
+
+// WithSyncDir syncs the cache file's directory after each refresh, so the new
+// content survives a system crash rather than only a process crash.
+func WithSyncDir() Option {
+	return func(o *options) {
+		o.syncDir = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		clock: clock.Real,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// NewFCache creates a new file cache. If fill returns an error, the refresh is
+// abandoned and the previous content kept.
+func NewFCache(dur time.Duration, fill func() ([]byte, error), opts ...Option) (*FCache, error) {
+	if fill == nil {
+		return nil, errors.New("fcache: fill is nil")
+	}
+
+	return NewStreamFCache(dur, func(w io.Writer) error {
+		b, err := fill()
+
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(b)
+		return err
+	}, opts...)
+}
+
+// NewStreamFCache creates a new file cache which fills by streaming into the
+// cache file, for content too large to hold in memory. If fill returns an
+// error, the refresh is abandoned and the previous content kept.
+func NewStreamFCache(dur time.Duration, fill func(io.Writer) error, opts ...Option) (*FCache, error) {
 	if dur <= 0 {
 		return nil, errors.New("fcache: duration <= 0")
 	} else if fill == nil {
 		return nil, errors.New("fcache: fill is nil")
 	}
 
+	o := newOptions(opts)
+
+	if o.shared && o.path == "" {
+		return nil, errors.New("fcache: shared without path")
+	}
+
 	fcache := &FCache{
 		dur:  dur,
 		fill: fill,
-		last: time.Now().UTC().Add(-dur),
+		opts: o,
+	}
+
+	if o.path != "" {
+		fcache.name = o.path
+
+		if h, err := checkFile(o.path); err == nil {
+			fcache.gen.Store(&generation{last: h.last})
+		}
+
+		return fcache, nil
 	}
 
 	f, err := ioutil.TempFile("", "*.fcache")
@@ -45,29 +161,186 @@ func NewFCache(dur time.Duration, fill func() []byte) (*FCache, error) {
 	return fcache, f.Close()
 }
 
-// Next retrieves the value in the cache.
+// Next retrieves the value in the cache. If the cache file is found to be
+// invalid or missing it is refilled rather than served. Fill errors are
+// returned.
 func (f *FCache) Next() ([]byte, error) {
-	f.mu.Lock()
+	g, err := f.acquire(nil)
+
+	if err != nil {
+		return nil, err
+	}
 
-	if time := time.Now().UTC(); time.Sub(f.last) > f.dur {
-		f.last = time
+	_, ret, err := readFile(f.name, f.opts.codecs)
 
-		if err := ioutil.WriteFile(f.name, f.fill(), 0600); err != nil {
-			f.mu.Unlock()
+	if err == ErrInvalid || os.IsNotExist(err) {
+		if _, err = f.acquire(g); err != nil {
 			return nil, err
 		}
+
+		_, ret, err = readFile(f.name, f.opts.codecs)
 	}
 
-	ret, err := ioutil.ReadFile(f.name)
+	return ret, err
+}
 
-	f.mu.Unlock()
+// Open opens the value in the cache for reading, without holding it in memory.
+// The reader remains valid, and keeps returning the same content, even if the
+// cache is refreshed or cleaned. Reading through to the end verifies the
+// content's checksum, returning ErrInvalid rather than io.EOF on a mismatch.
+//
+// The reader must be closed by the caller.
+func (f *FCache) Open() (io.ReadSeekCloser, error) {
+	g, err := f.acquire(nil)
 
-	return ret, err
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := openFile(f.name, f.opts.codecs)
+
+	if err == ErrInvalid || os.IsNotExist(err) {
+		if _, err = f.acquire(g); err != nil {
+			return nil, err
+		}
+
+		r, err = openFile(f.name, f.opts.codecs)
+	}
+
+	return r, err
 }
 
 // Clean removes the cache file. Future calls to Next will simply recreate the
-// file.
+// file. Safe to call concurrently with Next.
 func (f *FCache) Clean() error {
-	f.last = time.Now().UTC().Add(-f.dur)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed.Load() {
+		return ErrClosed
+	}
+
+	f.gen.Store(nil)
 	return os.Remove(f.name)
 }
+
+// Close makes further use of the cache return ErrClosed. The temporary cache
+// file is removed, while a file set by WithPath is kept so its content can be
+// reused after a restart. Readers opened by Open remain valid.
+func (f *FCache) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed.Swap(true) {
+		return ErrClosed
+	}
+
+	f.gen.Store(nil)
+
+	if f.opts.path != "" {
+		return nil
+	}
+
+	if err := os.Remove(f.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// acquire returns the published generation, refreshing it if it is expired or
+// invalid. Only one caller refreshes at a time. Meanwhile, the other callers
+// are served the expired generation rather than wait, unless there is none or
+// it is invalid.
+func (f *FCache) acquire(invalid *generation) (*generation, error) {
+	if f.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	g := f.gen.Load()
+
+	if f.fresh(g, invalid) {
+		return g, nil
+	}
+
+	if f.opts.shared {
+		if g2 := f.adopt(g, invalid); g2 != nil {
+			return g2, nil
+		}
+	}
+
+	wait := g == nil || g == invalid
+
+	if wait {
+		f.mu.Lock()
+	} else if !f.mu.TryLock() {
+		return g, nil
+	}
+
+	defer f.mu.Unlock()
+
+	if f.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	// Another caller may have refreshed while waiting for the lock.
+	if g = f.gen.Load(); f.fresh(g, invalid) {
+		return g, nil
+	}
+
+	if f.opts.shared {
+		l, err := lockFile(f.name+".lock", wait)
+
+		if err != nil {
+			return nil, err
+		} else if l == nil {
+			// Another process is refreshing.
+			return g, nil
+		}
+
+		defer unlockFile(l)
+
+		if g2 := f.adopt(g, invalid); g2 != nil {
+			return g2, nil
+		}
+	}
+
+	now := f.opts.clock.Now().UTC()
+
+	if _, err := writeFile(f.name, now, f.fill, &f.opts); err != nil {
+		return nil, err
+	}
+
+	g = &generation{last: now}
+	f.gen.Store(g)
+
+	return g, nil
+}
+
+// adopt publishes the cache file as a new generation if another process has
+// refreshed it, replacing the previous generation prev.
+func (f *FCache) adopt(prev, invalid *generation) *generation {
+	h, err := readHeader(f.name)
+
+	if err != nil {
+		return nil
+	}
+
+	g := &generation{last: h.last}
+
+	if !f.fresh(g, nil) || (invalid != nil && h.last.Equal(invalid.last)) {
+		return nil
+	}
+
+	if !f.gen.CompareAndSwap(prev, g) {
+		// Published concurrently, use that instead.
+		return f.gen.Load()
+	}
+
+	return g
+}
+
+func (f *FCache) fresh(g, invalid *generation) bool {
+	return g != nil && g != invalid &&
+		f.opts.clock.Now().UTC().Sub(g.last) <= f.dur
+}
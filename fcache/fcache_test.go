@@ -3,20 +3,30 @@ package fcache
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/esote/util/clock"
 )
 
 func TestSimple(t *testing.T) {
 	dur := 3 * time.Second
 
-	fill := func() []byte {
+	fill := func() ([]byte, error) {
 		b := make([]byte, 50)
 		_, _ = rand.Read(b)
-		return b
+		return b, nil
 	}
 
-	f, err := NewFCache(dur, fill)
+	clk := clock.NewFake(time.Now())
+	f, err := NewFCache(dur, fill, WithClock(clk))
 
 	if err != nil {
 		t.Fatal(err)
@@ -28,7 +38,7 @@ func TestSimple(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(3 * time.Second)
+	clk.Advance(dur + time.Second)
 
 	if b2, err = f.Next(); err != nil {
 		t.Fatal(err)
@@ -53,3 +63,434 @@ func TestSimple(t *testing.T) {
 
 	_ = f.Clean()
 }
+
+// Test that a cache bound to a path reuses its content after a restart.
+func TestPersist(t *testing.T) {
+	dur := time.Minute
+	path := filepath.Join(t.TempDir(), "data.fcache")
+	clk := clock.NewFake(time.Now())
+
+	var fills int
+
+	fill := func() ([]byte, error) {
+		fills++
+		return []byte{byte(fills)}, nil
+	}
+
+	f1, err := NewFCache(dur, fill, WithClock(clk), WithPath(path))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1, err := f1.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(dur / 2)
+
+	// Simulate a restart.
+	f2, err := NewFCache(dur, fill, WithClock(clk), WithPath(path))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2, err := f2.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b1, b2) || fills != 1 {
+		t.Fatalf("content not reused, %d fills", fills)
+	}
+
+	clk.Advance(dur)
+
+	f3, _ := NewFCache(dur, fill, WithClock(clk), WithPath(path))
+
+	if b2, err = f3.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(b1, b2) || fills != 2 {
+		t.Fatalf("expired content reused, %d fills", fills)
+	}
+
+	if err = f3.Clean(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that a truncated or corrupted cache file is refilled rather than served.
+func TestCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.fcache")
+
+	var fills int
+
+	fill := func() ([]byte, error) {
+		fills++
+		return bytes.Repeat([]byte{byte(fills)}, 100), nil
+	}
+
+	f, _ := NewFCache(time.Hour, fill, WithPath(path), WithSyncDir())
+
+	if _, err := f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := [][]byte{
+		b[:len(b)-10],
+		append(b[:len(b)-1:len(b)-1], b[len(b)-1]^1),
+		b[:headerLen-1],
+	}
+
+	for i, c := range corrupt {
+		if err = ioutil.WriteFile(path, c, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = checkFile(path); err != ErrInvalid {
+			t.Fatalf("corruption %d not detected: %v", i, err)
+		}
+
+		b2, err := f.Next()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := bytes.Repeat([]byte{byte(i + 2)}, 100); !bytes.Equal(b2, want) {
+			t.Fatalf("corruption %d served", i)
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp"))
+
+	if len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+// Test that streamed content stays readable across a refresh, and that a
+// failed fill keeps the previous content.
+func TestStream(t *testing.T) {
+	dur := time.Minute
+	clk := clock.NewFake(time.Now())
+	errFill := errors.New("fill failed")
+
+	var fills int
+
+	fill := func(w io.Writer) error {
+		fills++
+		if fills == 3 {
+			return errFill
+		}
+		for i := 0; i < 1000; i++ {
+			if _, err := fmt.Fprintf(w, "%d:%d\n", fills, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := NewStreamFCache(dur, fill, WithClock(clk))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Clean()
+
+	r1, err := f.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r1.Close()
+
+	clk.Advance(2 * dur)
+
+	b2, err := f.Next()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1, err := ioutil.ReadAll(r1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(b1, []byte("1:0\n")) || !bytes.HasPrefix(b2, []byte("2:0\n")) {
+		t.Fatal("snapshot changed by refresh")
+	}
+
+	if _, err = r1.Seek(-4, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	if end, _ := ioutil.ReadAll(r1); string(end) != "999\n" {
+		t.Fatalf("seek read %q", end)
+	}
+
+	clk.Advance(2 * dur)
+
+	if _, err = f.Next(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	clk.Advance(2 * dur)
+
+	if b1, err = f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(b1, []byte("4:0\n")) {
+		t.Fatal("refresh after failed fill")
+	}
+}
+
+// Test that reading an opened cache file through verifies its checksum.
+func TestOpenVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.fcache")
+
+	fill := func() ([]byte, error) {
+		return bytes.Repeat([]byte{1}, 100), nil
+	}
+
+	f, _ := NewFCache(time.Hour, fill, WithPath(path))
+
+	if _, err := f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-1] ^= 1
+
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := f.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if _, err = ioutil.ReadAll(r); err != ErrInvalid {
+		t.Fatalf("expected %v got %v", ErrInvalid, err)
+	}
+}
+
+// Test that readers are served the previous generation while a slow refresh is
+// in progress, rather than waiting on it.
+func TestReadDuringRefresh(t *testing.T) {
+	dur := time.Minute
+	clk := clock.NewFake(time.Now())
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var fills int
+
+	fill := func() ([]byte, error) {
+		fills++
+		if fills == 2 {
+			close(started)
+			<-release
+		}
+		return []byte{byte(fills)}, nil
+	}
+
+	f, _ := NewFCache(dur, fill, WithClock(clk))
+	defer f.Clean()
+
+	if _, err := f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(2 * dur)
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := f.Next()
+		done <- b
+	}()
+
+	<-started
+
+	for i := 0; i < 10; i++ {
+		b, err := f.Next()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, []byte{1}) {
+			t.Fatalf("expected previous generation got %v", b)
+		}
+	}
+
+	close(release)
+
+	if b := <-done; !bytes.Equal(b, []byte{2}) {
+		t.Fatalf("refresher got %v", b)
+	}
+
+	if b, _ := f.Next(); !bytes.Equal(b, []byte{2}) {
+		t.Fatalf("expected new generation got %v", b)
+	}
+}
+
+// Test that a failed fill is returned and the previous content kept.
+func TestFillError(t *testing.T) {
+	dur := time.Minute
+	clk := clock.NewFake(time.Now())
+	errFill := errors.New("fill failed")
+	fail := false
+
+	fill := func() ([]byte, error) {
+		if fail {
+			return nil, errFill
+		}
+		return []byte{1}, nil
+	}
+
+	f, _ := NewFCache(dur, fill, WithClock(clk))
+	defer f.Close()
+
+	if _, err := f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = true
+	clk.Advance(2 * dur)
+
+	if _, err := f.Next(); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	b, err := ioutil.ReadFile(f.name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b[headerLen:], []byte{1}) {
+		t.Fatal("previous content not kept")
+	}
+
+	fail = false
+
+	if b, err = f.Next(); err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Fatalf("got %v, %v", b, err)
+	}
+}
+
+// Test for race conditions when calling Clean and Next concurrently, run with
+// the -race flag.
+func TestCleanRace(t *testing.T) {
+	fill := func() ([]byte, error) {
+		return []byte{1}, nil
+	}
+
+	f, _ := NewFCache(time.Millisecond, fill)
+	defer f.Close()
+
+	reps := 200
+
+	var wg sync.WaitGroup
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func(i int) {
+			defer wg.Done()
+			if i%10 == 0 {
+				_ = f.Clean()
+				return
+			}
+			// Next retries once when the file was cleaned under
+			// it, so it can only miss if cleaned twice.
+			b, err := f.Next()
+			if os.IsNotExist(err) {
+				return
+			}
+			if err != nil || !bytes.Equal(b, []byte{1}) {
+				t.Errorf("got %v, %v", b, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClose(t *testing.T) {
+	fill := func() ([]byte, error) {
+		return []byte{1}, nil
+	}
+
+	f, _ := NewFCache(time.Hour, fill)
+
+	r, err := f.Open()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(f.name); !os.IsNotExist(err) {
+		t.Fatal("file not removed")
+	}
+
+	if _, err = f.Next(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if _, err = f.Open(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if err = f.Clean(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if err = f.Close(); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Fatalf("open reader got %v, %v", b, err)
+	}
+
+	// A file set by WithPath is kept for the next process.
+	path := filepath.Join(t.TempDir(), "data.fcache")
+	f, _ = NewFCache(time.Hour, fill, WithPath(path))
+
+	if _, err = f.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("file removed: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package fcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache files start with a header holding the time they were filled, so a cache
+// bound to a path can be reused after a restart, followed by the length and
+// checksum of the content, so truncated or corrupted files are never served.
+const headerLen = 28
+
+var (
+	// ErrInvalid means the cache file is not in the expected format, or its
+	// content does not match its length or checksum.
+	ErrInvalid = errors.New("fcache: invalid cache file")
+
+	magic = []byte("fcache\x00\x02")
+	table = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type header struct {
+	last time.Time
+	size uint64
+	sum  uint32
+}
+
+func (h header) encode() []byte {
+	b := make([]byte, headerLen)
+	copy(b, magic)
+	binary.BigEndian.PutUint64(b[8:], uint64(h.last.UnixNano()))
+	binary.BigEndian.PutUint64(b[16:], h.size)
+	binary.BigEndian.PutUint32(b[24:], h.sum)
+	return b
+}
+
+func decodeHeader(b []byte) (h header, err error) {
+	if len(b) < headerLen || !bytes.Equal(b[:len(magic)], magic) {
+		return h, ErrInvalid
+	}
+
+	h.last = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))).UTC()
+	h.size = binary.BigEndian.Uint64(b[16:])
+	h.sum = binary.BigEndian.Uint32(b[24:])
+	return h, nil
+}
+
+// readFile reads, validates, and decodes the cache file, returning its header
+// and content.
+func readFile(name string, codecs []Codec) (header, []byte, error) {
+	b, err := ioutil.ReadFile(name)
+
+	if err != nil {
+		return header{}, nil, err
+	}
+
+	h, err := decodeHeader(b)
+
+	if err != nil {
+		return h, nil, err
+	}
+
+	data := b[headerLen:]
+
+	if uint64(len(data)) != h.size || crc32.Checksum(data, table) != h.sum {
+		return h, nil, ErrInvalid
+	}
+
+	data, err = decodeAll(data, codecs)
+	return h, data, err
+}
+
+// readHeader reads the header of the cache file, without validating its
+// content.
+func readHeader(name string) (header, error) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return header{}, err
+	}
+
+	defer f.Close()
+
+	b := make([]byte, headerLen)
+
+	if _, err = io.ReadFull(f, b); err != nil {
+		return header{}, ErrInvalid
+	}
+
+	return decodeHeader(b)
+}
+
+// checkFile validates the cache file without holding its content in memory,
+// returning its header.
+func checkFile(name string) (h header, err error) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	b := make([]byte, headerLen)
+
+	if _, err = io.ReadFull(f, b); err != nil {
+		return h, ErrInvalid
+	}
+
+	if h, err = decodeHeader(b); err != nil {
+		return
+	}
+
+	crc := crc32.New(table)
+
+	if n, err := io.Copy(crc, f); err != nil {
+		return h, err
+	} else if uint64(n) != h.size || crc.Sum32() != h.sum {
+		return h, ErrInvalid
+	}
+
+	return h, nil
+}
+
+// writeFile atomically replaces the cache file with the content written by
+// fill. The content is written to a temporary file in the same directory,
+// synced, and renamed over the cache file, so a crash never leaves a partially
+// written cache file behind. If syncDir, the directory is synced after the
+// rename so it survives a crash as well. Returns the size of the cache file.
+func writeFile(name string, last time.Time, fill func(io.Writer) error, o *options) (size int64, err error) {
+	dir, base := filepath.Split(name)
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	// Reserve space for the header, which is written once the length and
+	// checksum of the content are known.
+	if _, err = tmp.Write(make([]byte, headerLen)); err != nil {
+		return
+	}
+
+	buf := bufio.NewWriter(tmp)
+	crc := crc32.New(table)
+	w := &countWriter{w: io.MultiWriter(buf, crc)}
+
+	cw, flush, err := encode(w, o.codecs)
+
+	if err != nil {
+		return
+	}
+
+	if err = fill(cw); err != nil {
+		return
+	}
+
+	if err = flush(); err != nil {
+		return
+	}
+
+	if err = buf.Flush(); err != nil {
+		return
+	}
+
+	h := header{
+		last: last,
+		size: w.n,
+		sum:  crc.Sum32(),
+	}
+
+	if _, err = tmp.WriteAt(h.encode(), 0); err != nil {
+		return
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return
+	}
+
+	if o.syncDir {
+		if err = syncPath(filepath.Dir(name)); err != nil {
+			return
+		}
+	}
+
+	return headerLen + int64(h.size), nil
+}
+
+func syncPath(name string) error {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// openFile opens the cache file for reading its content, validating its header
+// and length.
+func openFile(name string, codecs []Codec) (io.ReadSeekCloser, error) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, headerLen)
+
+	if _, err = io.ReadFull(f, b); err != nil {
+		_ = f.Close()
+		return nil, ErrInvalid
+	}
+
+	h, err := decodeHeader(b)
+
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if uint64(fi.Size()) != headerLen+h.size {
+		_ = f.Close()
+		return nil, ErrInvalid
+	}
+
+	s := &snapshot{
+		SectionReader: io.NewSectionReader(f, headerLen, int64(h.size)),
+		crc:           crc32.New(table),
+		f:             f,
+		sum:           h.sum,
+		verify:        true,
+	}
+
+	if len(codecs) == 0 {
+		return s, nil
+	}
+
+	r, err := decode(s, codecs)
+
+	if err != nil {
+		_ = f.Close()
+		return nil, ErrInvalid
+	}
+
+	return &decoded{
+		codecs: codecs,
+		r:      r,
+		s:      s,
+	}, nil
+}
+
+// snapshot reads the content of an opened cache file. Refreshes replace the
+// cache file rather than write to it, so the snapshot is unaffected by them.
+type snapshot struct {
+	*io.SectionReader
+	crc    hash.Hash32
+	f      *os.File
+	n      int64
+	sum    uint32
+	verify bool
+}
+
+// Read verifies the checksum when the content is read sequentially from the
+// start.
+func (s *snapshot) Read(p []byte) (n int, err error) {
+	n, err = s.SectionReader.Read(p)
+
+	if s.verify {
+		_, _ = s.crc.Write(p[:n])
+		s.n += int64(n)
+
+		if err == io.EOF && s.crc.Sum32() != s.sum {
+			err = ErrInvalid
+		}
+	}
+
+	return
+}
+
+// Seek stops verifying the checksum, unless seeking to the start or to where
+// sequential reading left off.
+func (s *snapshot) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.SectionReader.Seek(offset, whence)
+
+	if err != nil {
+		return pos, err
+	}
+
+	if pos == 0 {
+		s.crc.Reset()
+		s.n = 0
+		s.verify = true
+	} else if pos != s.n {
+		s.verify = false
+	}
+
+	return pos, nil
+}
+
+func (s *snapshot) Close() error {
+	return s.f.Close()
+}
+
+// decoded reads the decoded content of a snapshot. Encoded content cannot be
+// seeked directly, so seeking backwards decodes again from the start, and
+// seeking relative to the end is not supported.
+type decoded struct {
+	codecs []Codec
+	pos    int64
+	r      io.Reader
+	s      *snapshot
+}
+
+// Read drains the snapshot once the decoded content ends, as some decoders
+// stop short of its end, so the checksum is still verified.
+func (d *decoded) Read(p []byte) (n int, err error) {
+	n, err = d.r.Read(p)
+	d.pos += int64(n)
+
+	if err == io.EOF {
+		if _, derr := io.Copy(ioutil.Discard, d.s); derr != nil {
+			err = derr
+		}
+	}
+
+	return
+}
+
+func (d *decoded) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	default:
+		return d.pos, errors.New("fcache: seek relative to end of encoded content")
+	}
+
+	if offset < 0 {
+		return d.pos, errors.New("fcache: negative position")
+	}
+
+	if offset < d.pos {
+		if _, err := d.s.Seek(0, io.SeekStart); err != nil {
+			return d.pos, err
+		}
+
+		r, err := decode(d.s, d.codecs)
+
+		if err != nil {
+			return d.pos, err
+		}
+
+		d.r = r
+		d.pos = 0
+	}
+
+	n, err := io.CopyN(ioutil.Discard, d.r, offset-d.pos)
+	d.pos += n
+
+	if err == io.EOF {
+		// Seeking past the end is allowed, further reads return EOF.
+		d.pos = offset
+		err = nil
+	}
+
+	return d.pos, err
+}
+
+func (d *decoded) Close() error {
+	return d.s.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += uint64(n)
+	return
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package fcache
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoLock = errors.New("fcache: file locks not supported")
+
+func lockFile(name string, wait bool) (*os.File, error) {
+	return nil, errNoLock
+}
+
+func unlockFile(f *os.File) error {
+	return errNoLock
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package fcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at name, creating it if needed.
+// If wait is false and another process holds the lock, a nil file is returned.
+func lockFile(name string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		if err = syscall.Flock(int(f.Fd()), how); err != syscall.EINTR {
+			break
+		}
+	}
+
+	if err != nil {
+		_ = f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+
+		return nil, &os.PathError{Op: "flock", Path: name, Err: err}
+	}
+
+	return f, nil
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package fcache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/esote/util/clock"
+)
+
+// Test that caches sharing a path, as separate processes would, fill only once
+// and read the previous content while another is refreshing.
+func TestShared(t *testing.T) {
+	dur := time.Minute
+	path := filepath.Join(t.TempDir(), "data.fcache")
+	clk := clock.NewFake(time.Now())
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var fills int
+
+	fill := func() ([]byte, error) {
+		fills++
+		if fills == 2 {
+			close(started)
+			<-release
+		}
+		return []byte{byte(fills)}, nil
+	}
+
+	a, err := NewFCache(dur, fill, WithClock(clk), WithPath(path), WithShared())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := NewFCache(dur, fill, WithClock(clk), WithPath(path), WithShared())
+
+	if v, _ := a.Next(); !bytes.Equal(v, []byte{1}) {
+		t.Fatalf("expected first fill got %v", v)
+	}
+
+	if v, _ := b.Next(); !bytes.Equal(v, []byte{1}) || fills != 1 {
+		t.Fatalf("expected first fill got %v, %d fills", v, fills)
+	}
+
+	clk.Advance(2 * dur)
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = a.Next()
+		close(done)
+	}()
+
+	<-started
+
+	if v, err := b.Next(); err != nil || !bytes.Equal(v, []byte{1}) {
+		t.Fatalf("expected previous content got %v, %v", v, err)
+	}
+
+	close(release)
+	<-done
+
+	if v, _ := b.Next(); !bytes.Equal(v, []byte{2}) || fills != 2 {
+		t.Fatalf("expected second fill got %v, %d fills", v, fills)
+	}
+
+	if _, err = NewFCache(dur, fill, WithShared()); err == nil {
+		t.Fatal("shared without path accepted")
+	}
+}
@@ -0,0 +1,87 @@
+package pool
+
+import "context"
+
+// Future is the eventual result of a job from Submit.
+type Future[T any] struct {
+	done chan struct{}
+	err  error
+	val  T
+}
+
+// Submit a job to the worker pool, waiting until a worker has accepted it or
+// ctx is done. The job is called with a context which is cancelled when ctx is
+// done or the pool is shut down. If the job is never called, the future holds
+// ctx's error, or ErrClosed if the pool was shut down first.
+// If the job panics, the future holds the *PanicError. The job has Normal
+// priority.
+func Submit[T any](ctx context.Context, p *Pool, f func(context.Context) (T, error)) *Future[T] {
+	return SubmitPriority(ctx, p, Normal, f)
+}
+
+// SubmitPriority is like Submit, but the job has the given priority.
+func SubmitPriority[T any](ctx context.Context, p *Pool, prio Priority, f func(context.Context) (T, error)) *Future[T] {
+	fut := &Future[T]{
+		done: make(chan struct{}),
+	}
+
+	run := func(...interface{}) {
+		ctx, cancel := p.jobContext(ctx)
+		defer cancel()
+
+		if err := ctx.Err(); err != nil {
+			fut.fail(err)
+			return
+		}
+
+		fut.resolve(f(ctx))
+	}
+
+	if err := p.enlist(ctx, prio, true, job{f: run, abort: fut.fail}); err != nil {
+		fut.fail(err)
+	}
+
+	return fut
+}
+
+// Done returns a channel which is closed once the result is available.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait for the result of the job, or until ctx is done.
+func (f *Future[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (f *Future[T]) resolve(val T, err error) {
+	f.val, f.err = val, err
+	close(f.done)
+}
+
+func (f *Future[T]) fail(err error) {
+	var zero T
+	f.resolve(zero, err)
+}
+
+// jobContext derives the context of a job from ctx, also cancelled when the
+// pool is closed.
+func (p *Pool) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,85 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSubmit(t *testing.T) {
+	p := New(2, 10)
+	defer p.Close(false)
+
+	ctx := context.Background()
+	errJob := errors.New("job failed")
+
+	square := Submit(ctx, p, func(context.Context) (int, error) {
+		return 7 * 7, nil
+	})
+
+	fail := Submit(ctx, p, func(context.Context) (int, error) {
+		return 0, errJob
+	})
+
+	if v, err := square.Wait(ctx); err != nil || v != 49 {
+		t.Fatalf("got %d, %v", v, err)
+	}
+
+	<-fail.Done()
+
+	if _, err := fail.Wait(ctx); err != errJob {
+		t.Fatalf("expected %v got %v", errJob, err)
+	}
+}
+
+// Test that jobs are cancelled when the pool is closed, and that jobs which
+// never run still resolve their future.
+func TestSubmitCancel(t *testing.T) {
+	p := New(1, 1)
+	ctx := context.Background()
+	started := make(chan struct{})
+
+	running := Submit(ctx, p, func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+
+	<-started
+
+	flushed := Submit(ctx, p, func(context.Context) (int, error) {
+		return 1, nil
+	})
+
+	p.Close(true)
+
+	if _, err := running.Wait(ctx); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	if _, err := flushed.Wait(ctx); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	p = New(1, 0)
+	defer p.Close(false)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	Submit(ctx, p, func(context.Context) (int, error) {
+		<-block
+		return 0, nil
+	})
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	late := Submit(cctx, p, func(context.Context) (int, error) {
+		return 1, nil
+	})
+
+	if _, err := late.Wait(ctx); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+}
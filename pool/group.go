@@ -0,0 +1,103 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Group is a collection of related jobs run by a pool, similar to errgroup.
+// The first job to fail cancels the context of the others.
+type Group struct {
+	cancel context.CancelFunc
+	ctx    context.Context
+	err    error
+	once   sync.Once
+	pool   *Pool
+	sem    chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewGroup creates a new group of jobs run by p. The returned context is
+// cancelled when a job fails or Wait returns.
+func NewGroup(ctx context.Context, p *Pool) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Group{
+		cancel: cancel,
+		ctx:    ctx,
+		pool:   p,
+	}, ctx
+}
+
+// SetLimit limits the group to n jobs enlisted or running at once, regardless
+// of the size of the pool. Must be called before Go.
+func (g *Group) SetLimit(n int) error {
+	if n <= 0 {
+		return errors.New("pool: group limit <= 0")
+	}
+
+	g.sem = make(chan struct{}, n)
+	return nil
+}
+
+// Go runs f in the pool, waiting until a worker has accepted it and, with
+// SetLimit, until fewer than the limit of jobs are in flight. The context given
+// to f is cancelled when a job in the group fails, or the pool is shut down.
+// Jobs which have not started when the group's context is cancelled are not
+// run, and the cancellation is reported by Wait unless a job already failed.
+func (g *Group) Go(f func(ctx context.Context) error) {
+	if g.sem != nil {
+		select {
+		case g.sem <- struct{}{}:
+		case <-g.ctx.Done():
+			g.fail(g.ctx.Err())
+			return
+		}
+	}
+
+	g.wg.Add(1)
+
+	finish := func(err error) {
+		if err != nil {
+			g.fail(err)
+		}
+
+		if g.sem != nil {
+			<-g.sem
+		}
+
+		g.wg.Done()
+	}
+
+	run := func(...interface{}) {
+		ctx, cancel := g.pool.jobContext(g.ctx)
+		defer cancel()
+
+		if err := ctx.Err(); err != nil {
+			finish(err)
+			return
+		}
+
+		finish(f(ctx))
+	}
+
+	if err := g.pool.enlist(g.ctx, Normal, true, job{f: run, abort: finish}); err != nil {
+		finish(err)
+	}
+}
+
+// Wait for all jobs in the group to return, and returns the first error.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+
+	return g.err
+}
+
+func (g *Group) fail(err error) {
+	g.once.Do(func() {
+		g.err = err
+		g.cancel()
+	})
+}
@@ -0,0 +1,133 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	p := New(4, 10)
+	defer p.Close(false)
+
+	var sum int64
+
+	g, _ := NewGroup(context.Background(), p)
+
+	for i := 1; i <= 10; i++ {
+		i := int64(i)
+		g.Go(func(context.Context) error {
+			atomic.AddInt64(&sum, i)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum != 55 {
+		t.Fatalf("expected %d got %d", 55, sum)
+	}
+}
+
+// Test that the first error is returned, and cancels the other jobs.
+func TestGroupError(t *testing.T) {
+	p := New(4, 10)
+	defer p.Close(false)
+
+	errJob := errors.New("job failed")
+
+	g, ctx := NewGroup(context.Background(), p)
+
+	for i := 0; i < 3; i++ {
+		g.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+
+	g.Go(func(context.Context) error {
+		return errJob
+	})
+
+	if err := g.Wait(); err != errJob {
+		t.Fatalf("expected %v got %v", errJob, err)
+	}
+
+	if ctx.Err() == nil {
+		t.Fatal("group context not cancelled")
+	}
+}
+
+// Test that the group limit is respected, independent of the pool size.
+func TestGroupLimit(t *testing.T) {
+	const limit = 2
+
+	p := New(8, 10)
+	defer p.Close(false)
+
+	var running, peak int64
+
+	g, _ := NewGroup(context.Background(), p)
+
+	if err := g.SetLimit(limit); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		g.Go(func(context.Context) error {
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				m := atomic.LoadInt64(&peak)
+				if n <= m || atomic.CompareAndSwapInt64(&peak, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if peak > limit {
+		t.Fatalf("%d jobs in flight, expected at most %d", peak, limit)
+	}
+
+	if err := g.SetLimit(0); err == nil {
+		t.Fatal("zero limit accepted")
+	}
+}
+
+// Test that jobs skipped because the parent context was cancelled are
+// reported by Wait.
+func TestGroupCancel(t *testing.T) {
+	p := New(1, 10)
+	defer p.Close(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	g, _ := NewGroup(ctx, p)
+
+	var ran int64
+
+	g.Go(func(context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	})
+
+	if err := g.Wait(); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	if ran != 0 {
+		t.Fatal("job ran after cancellation")
+	}
+}
@@ -2,30 +2,114 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrClosed is returned when using a pool which was shut down.
+	ErrClosed = errors.New("pool: pool closed")
+
+	// ErrFull is returned when no worker was available to accept a job.
+	ErrFull = errors.New("pool: backlog full")
 )
 
 // Pool is a worker pool.
 type Pool struct {
-	done uint64
-	jobs chan job
-	wg   sync.WaitGroup
+	cancel  context.CancelFunc
+	closed  bool
+	ctx     context.Context
+	done    uint64
+	dropped uint64
+	jobs    [levels]chan job
+	mu      sync.RWMutex
+	opts    options
+	quit    chan struct{}
+	retire  chan struct{}
+	senders sync.WaitGroup
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	workers int
 }
 
 type job struct {
-	f    func(args ...interface{})
-	args []interface{}
+	f     func(args ...interface{})
+	args  []interface{}
+	abort func(err error)
+}
+
+// Option configures a worker pool.
+type Option func(*options)
+
+type options struct {
+	fair  int
+	idle  time.Duration
+	max   int
+	min   int
+	panic func(err error)
 }
 
-// New constructs a new worker pool. Panics if workers <= 0.
-func New(workers, backlog int) *Pool {
+// WithPanicHandler reports jobs which panicked to handler, with a *PanicError.
+// By default, they are logged with the standard logger.
+func WithPanicHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.panic = handler
+	}
+}
+
+// PanicError is a panic recovered from a job.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("pool: job panicked: %v\n%s", e.Value, e.Stack)
+}
+
+// New constructs a new worker pool. Panics if workers <= 0. Jobs which panic
+// are recovered, and the worker carries on with the next job.
+func New(workers, backlog int, opts ...Option) *Pool {
 	if workers <= 0 {
 		panic("pool: not enough workers")
 	}
 
+	o := options{
+		fair: 10,
+		panic: func(err error) {
+			log.Print(err)
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.max > 0 && (o.idle <= 0 || o.min <= 0 || o.max < o.min ||
+		workers < o.min || workers > o.max) {
+		panic("pool: invalid autoscale range")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	p := &Pool{
-		jobs: make(chan job, backlog),
+		cancel:  cancel,
+		ctx:     ctx,
+		opts:    o,
+		quit:    make(chan struct{}),
+		retire:  make(chan struct{}),
+		stop:    make(chan struct{}),
+		workers: workers,
+	}
+
+	for i := range p.jobs {
+		p.jobs[i] = make(chan job, backlog)
 	}
 
 	p.wg.Add(workers)
@@ -38,45 +122,221 @@ func New(workers, backlog int) *Pool {
 }
 
 // Enlist the worker pool with a new job. The arguments will be passed to f. If
-// blocking, this function waits until a worker has accepted the job. This
-// function returns whether a worker was available to accept the job.
-func (p *Pool) Enlist(block bool, f func(args ...interface{}), args ...interface{}) bool {
-	if block {
-		p.jobs <- job{f, args}
-		return true
+// blocking, this function waits until a worker has accepted the job, otherwise
+// it returns ErrFull if no worker was available to accept the job. After the
+// pool is shut down, ErrClosed is returned. The job has Normal priority.
+func (p *Pool) Enlist(block bool, f func(args ...interface{}), args ...interface{}) error {
+	return p.EnlistPriority(Normal, block, f, args...)
+}
+
+func (p *Pool) enlist(ctx context.Context, prio Priority, block bool, j job) error {
+	if prio < Low || prio > High {
+		return errors.New("pool: invalid priority")
 	}
 
+	jobs := p.jobs[prio]
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrClosed
+	}
+	p.senders.Add(1)
+	p.mu.RUnlock()
+
+	defer p.senders.Done()
+
 	select {
-	case p.jobs <- job{f, args}:
-		return true
+	case jobs <- j:
+		if len(jobs) > 0 {
+			// The backlog is building up.
+			p.grow()
+		}
+		return nil
 	default:
-		return false
+		p.grow()
+	}
+
+	if !block {
+		select {
+		case jobs <- j:
+			return nil
+		default:
+			return ErrFull
+		}
+	}
+
+	select {
+	case jobs <- j:
+		return nil
+	case <-p.quit:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown the worker pool. New jobs are no longer accepted, and Shutdown
+// waits for the job backlog to be consumed and running jobs to return until
+// ctx is done. Then the contexts of jobs from Submit are cancelled, the
+// remaining backlog is dropped, and ctx's error is returned without waiting
+// for running jobs any longer. Returns the number of jobs dropped, or
+// ErrClosed if already shut down.
+func (p *Pool) Shutdown(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, ErrClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	// Jobs are no longer sent once blocked senders have returned.
+	close(p.quit)
+	p.senders.Wait()
+	close(p.stop)
+
+	done := make(chan struct{})
+
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		atomic.StoreUint64(&p.done, 1)
+		p.cancel()
+
+		// Workers may be stuck in jobs, so drop the backlog here.
+		for {
+			j, ok := p.poll(0)
+			if !ok {
+				break
+			}
+			p.handle(j)
+		}
 	}
+
+	p.cancel()
+
+	return int(atomic.LoadUint64(&p.dropped)), err
 }
 
-// Close the worker pool. Waits for the job backlog to be consumed. Further use
-// of the pool is undefined behavior. When flushing, the jobs in the job backlog
-// are ignored and simply consumed rather than called.
+// Close the worker pool. Waits for the job backlog to be consumed and running
+// jobs to return. Panics if the pool is already closed. When flushing, the
+// jobs in the job backlog are dropped rather than called, see Shutdown.
 func (p *Pool) Close(flush bool) {
-	var n uint64
+	ctx := context.Background()
+
 	if flush {
-		n = 1
-	} else {
-		defer atomic.SwapUint64(&p.done, 1)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		cancel()
 	}
-	if !atomic.CompareAndSwapUint64(&p.done, 0, n) {
+
+	if _, err := p.Shutdown(ctx); err == ErrClosed {
 		panic("pool: close on closed pool")
 	}
-	close(p.jobs)
+
 	p.wg.Wait()
 }
 
 func (p *Pool) worker() {
 	defer p.wg.Done()
-	for job := range p.jobs {
-		if atomic.CompareAndSwapUint64(&p.done, 1, 1) {
+
+	var (
+		idle  <-chan time.Time
+		timer *time.Timer
+	)
+
+	if p.opts.idle > 0 {
+		timer = time.NewTimer(p.opts.idle)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	var n int
+
+	do := func(j job) {
+		p.handle(j)
+		n++
+
+		if timer != nil {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(p.opts.idle)
+		}
+	}
+
+	for {
+		if j, ok := p.poll(n); ok {
+			do(j)
 			continue
 		}
-		job.f(job.args...)
+
+		select {
+		case j := <-p.jobs[High]:
+			do(j)
+		case j := <-p.jobs[Normal]:
+			do(j)
+		case j := <-p.jobs[Low]:
+			do(j)
+		case <-p.stop:
+			// No more jobs are sent, consume the backlog.
+			for {
+				j, ok := p.poll(n)
+				if !ok {
+					return
+				}
+				do(j)
+			}
+		case <-p.retire:
+			return
+		case <-idle:
+			if p.shrink() {
+				return
+			}
+			timer.Reset(p.opts.idle)
+		}
+	}
+}
+
+func (p *Pool) handle(j job) {
+	if atomic.LoadUint64(&p.done) == 1 {
+		atomic.AddUint64(&p.dropped, 1)
+		if j.abort != nil {
+			j.abort(ErrClosed)
+		}
+		return
 	}
+
+	p.run(j)
+}
+
+func (p *Pool) run(j job) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := &PanicError{
+				Value: r,
+				Stack: debug.Stack(),
+			}
+
+			if j.abort != nil {
+				j.abort(err)
+			}
+
+			p.opts.panic(err)
+		}
+	}()
+
+	j.f(j.args...)
 }
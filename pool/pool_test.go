@@ -1,6 +1,9 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -36,7 +39,7 @@ func TestPoolNonblocking(t *testing.T) {
 
 	var dropped uint64
 	for i := 0; i < n; i++ {
-		if !p.Enlist(false, f, i) {
+		if err := p.Enlist(false, f, i); err == ErrFull {
 			dropped++
 		}
 	}
@@ -77,3 +80,146 @@ func TestCloseFlush(t *testing.T) {
 	}
 
 }
+
+func TestPanic(t *testing.T) {
+	errs := make(chan error, 2)
+
+	p := New(1, 0, WithPanicHandler(func(err error) {
+		errs <- err
+	}))
+
+	p.Enlist(true, func(args ...interface{}) {
+		panic("oops")
+	})
+
+	var pe *PanicError
+
+	if err := <-errs; !errors.As(err, &pe) || pe.Value != "oops" ||
+		!strings.Contains(string(pe.Stack), "TestPanic") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// The worker is still alive.
+	ctx := context.Background()
+
+	f := Submit(ctx, p, func(context.Context) (int, error) {
+		panic("oops")
+	})
+
+	if _, err := f.Wait(ctx); !errors.As(err, &pe) {
+		t.Fatalf("expected panic error got %v", err)
+	}
+
+	<-errs
+
+	p.Close(false)
+}
+
+func TestShutdown(t *testing.T) {
+	var i uint64
+
+	f := func(args ...interface{}) {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddUint64(&i, 1)
+	}
+
+	p := New(1, 10)
+
+	for j := 0; j < 3; j++ {
+		_ = p.Enlist(true, f, j)
+	}
+
+	if dropped, err := p.Shutdown(context.Background()); err != nil || dropped != 0 {
+		t.Fatalf("got %d, %v", dropped, err)
+	}
+
+	if i != 3 {
+		t.Fatalf("expected %d got %d", 3, i)
+	}
+
+	if err := p.Enlist(true, f); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	ctx := context.Background()
+
+	fut := Submit(ctx, p, func(context.Context) (int, error) {
+		return 1, nil
+	})
+
+	if _, err := fut.Wait(ctx); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	if _, err := p.Shutdown(ctx); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+
+	p = New(1, 10)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	_ = p.Enlist(true, func(args ...interface{}) {
+		close(started)
+		<-release
+	})
+
+	<-started
+
+	for j := 0; j < 4; j++ {
+		_ = p.Enlist(true, f, j)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	// The running job is not waited for once ctx is done, the backlog is
+	// dropped.
+	dropped, err := p.Shutdown(ctx)
+
+	close(release)
+
+	if err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	if dropped != 4 {
+		t.Fatalf("expected %d dropped got %d", 4, dropped)
+	}
+}
+
+// Test that Shutdown returns once its context is done, even if a job never
+// returns.
+func TestShutdownStuck(t *testing.T) {
+	p := New(1, 10)
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	started := make(chan struct{})
+
+	_ = p.Enlist(true, func(args ...interface{}) {
+		close(started)
+		<-stuck
+	})
+
+	<-started
+
+	for j := 0; j < 3; j++ {
+		_ = p.Enlist(true, func(args ...interface{}) {})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	dropped, err := p.Shutdown(ctx)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+
+	if dropped != 3 {
+		t.Fatalf("expected %d dropped got %d", 3, dropped)
+	}
+}
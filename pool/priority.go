@@ -0,0 +1,63 @@
+package pool
+
+import "context"
+
+// Priority of a job. Workers take jobs with higher priority first.
+type Priority int
+
+// Job priorities.
+const (
+	Low Priority = iota
+	Normal
+	High
+
+	levels = int(High) + 1
+)
+
+// WithFairness sets how often workers take a job without regard to priority,
+// so lower priority jobs are not starved: every n-th job a worker takes is
+// taken from each priority in turn. The default is 10, and 0 strictly orders
+// jobs by priority.
+func WithFairness(n int) Option {
+	return func(o *options) {
+		o.fair = n
+	}
+}
+
+// EnlistPriority is like Enlist, but the job has the given priority. Each
+// priority has its own job backlog.
+func (p *Pool) EnlistPriority(prio Priority, block bool, f func(args ...interface{}), args ...interface{}) error {
+	return p.enlist(context.Background(), prio, block, job{f: f, args: args})
+}
+
+// Backlog returns the number of jobs with the given priority waiting for a
+// worker.
+func (p *Pool) Backlog(prio Priority) int {
+	if prio < Low || prio > High {
+		return 0
+	}
+
+	return len(p.jobs[prio])
+}
+
+// poll takes the next job without waiting, by priority unless it is the n-th
+// job's turn for fairness.
+func (p *Pool) poll(n int) (job, bool) {
+	start := High
+
+	if f := p.opts.fair; f > 0 && n%f == f-1 {
+		start = Priority((n / f) % levels)
+	}
+
+	for i := 0; i < levels; i++ {
+		prio := (int(start) - i + levels) % levels
+
+		select {
+		case j := <-p.jobs[prio]:
+			return j, true
+		default:
+		}
+	}
+
+	return job{}, false
+}
@@ -0,0 +1,70 @@
+package pool
+
+import (
+	"sync"
+	"testing"
+)
+
+// Test that jobs run by priority, and that low priority jobs get a turn.
+func TestPriority(t *testing.T) {
+	for _, fair := range []int{0, 2} {
+		p := New(1, 10, WithFairness(fair))
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		_ = p.Enlist(true, func(args ...interface{}) {
+			close(started)
+			<-release
+		})
+
+		<-started
+
+		var (
+			mu    sync.Mutex
+			order []Priority
+		)
+
+		f := func(args ...interface{}) {
+			mu.Lock()
+			order = append(order, args[0].(Priority))
+			mu.Unlock()
+		}
+
+		_ = p.EnlistPriority(Low, true, f, Low)
+		_ = p.EnlistPriority(Normal, true, f, Normal)
+
+		for i := 0; i < 4; i++ {
+			_ = p.EnlistPriority(High, true, f, High)
+		}
+
+		if p.Backlog(Low) != 1 || p.Backlog(Normal) != 1 || p.Backlog(High) != 4 {
+			t.Fatalf("unexpected backlog %d, %d, %d", p.Backlog(Low),
+				p.Backlog(Normal), p.Backlog(High))
+		}
+
+		close(release)
+		p.Close(false)
+
+		want := []Priority{High, High, High, High, Normal, Low}
+
+		if fair > 0 {
+			// Every second job is taken by turn: Low, then Normal.
+			want = []Priority{Low, High, Normal, High, High, High}
+		}
+
+		for i := range want {
+			if order[i] != want[i] {
+				t.Fatalf("fairness %d: expected order %v got %v",
+					fair, want, order)
+			}
+		}
+	}
+
+	p := New(1, 0)
+	defer p.Close(false)
+
+	if err := p.EnlistPriority(High+1, true, func(...interface{}) {}); err == nil {
+		t.Fatal("invalid priority accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"errors"
+	"time"
+)
+
+// WithAutoscale grows the pool by a worker at a time, up to max workers, while
+// the job backlog is not empty or no worker is available to accept a job.
+// Workers idle for the idle timeout are retired, down to min workers.
+func WithAutoscale(min, max int, idle time.Duration) Option {
+	return func(o *options) {
+		o.min = min
+		o.max = max
+		o.idle = idle
+	}
+}
+
+// Resize the pool to n workers. Workers which are retired finish their current
+// job first. With WithAutoscale, n must be within the autoscale range.
+func (p *Pool) Resize(n int) error {
+	if n <= 0 {
+		return errors.New("pool: not enough workers")
+	} else if p.opts.max > 0 && (n < p.opts.min || n > p.opts.max) {
+		return errors.New("pool: workers not in autoscale range")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	for ; p.workers < n; p.workers++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+
+	for ; p.workers > n; p.workers-- {
+		go func() {
+			select {
+			case p.retire <- struct{}{}:
+			case <-p.quit:
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Workers returns the number of workers in the pool, not counting workers
+// still finishing their job after being retired.
+func (p *Pool) Workers() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.workers
+}
+
+// grow adds a worker when autoscaling, unless there are already max workers.
+func (p *Pool) grow() {
+	if p.opts.max == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.workers >= p.opts.max {
+		return
+	}
+
+	p.workers++
+	p.wg.Add(1)
+	go p.worker()
+}
+
+// shrink reports whether an idle worker should retire, unless there are only
+// min workers.
+func (p *Pool) shrink() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers <= p.opts.min {
+		return false
+	}
+
+	p.workers--
+	return true
+}
@@ -0,0 +1,100 @@
+package pool
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitWorkers waits for the pool to reach n workers.
+func waitWorkers(t *testing.T, p *Pool, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if p.Workers() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d workers got %d", n, p.Workers())
+}
+
+func TestResize(t *testing.T) {
+	var running int64
+
+	release := make(chan struct{})
+
+	f := func(args ...interface{}) {
+		atomic.AddInt64(&running, 1)
+		<-release
+	}
+
+	p := New(1, 10)
+
+	if err := p.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		_ = p.Enlist(true, f)
+	}
+
+	// All four jobs run at once.
+	for atomic.LoadInt64(&running) != 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Resize(2); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+
+	if p.Workers() != 2 {
+		t.Fatalf("expected %d workers got %d", 2, p.Workers())
+	}
+
+	if err := p.Resize(0); err == nil {
+		t.Fatal("zero workers accepted")
+	}
+
+	p.Close(false)
+
+	if err := p.Resize(1); err != ErrClosed {
+		t.Fatalf("expected %v got %v", ErrClosed, err)
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	const idle = 20 * time.Millisecond
+
+	release := make(chan struct{})
+
+	f := func(args ...interface{}) {
+		<-release
+	}
+
+	p := New(1, 0, WithAutoscale(1, 3, idle))
+
+	// Each blocked job spawns a worker for the next, up to the maximum.
+	for i := 0; i < 3; i++ {
+		if err := p.Enlist(true, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p.Workers() != 3 {
+		t.Fatalf("expected %d workers got %d", 3, p.Workers())
+	}
+
+	close(release)
+
+	waitWorkers(t, p, 1)
+
+	if err := p.Resize(4); err == nil {
+		t.Fatal("workers above autoscale range accepted")
+	}
+
+	p.Close(false)
+}
@@ -107,6 +107,13 @@ func (s *Splay) OpenFile(name string, flag int, perm os.FileMode) (*os.File, err
 	return os.OpenFile(file, flag, perm)
 }
 
+// Path returns the path of the splay file, whether or not it exists. Useful
+// for file operations the splay does not provide, such as renaming.
+func (s *Splay) Path(name string) (string, error) {
+	_, file, err := s.parts(name)
+	return file, err
+}
+
 // Read the entirety of a file from the splay.
 func (s *Splay) Read(name string) ([]byte, error) {
 	_, file, err := s.parts(name)
@@ -2,6 +2,7 @@ package splay
 
 import (
 	"bytes"
+	"path/filepath"
 	"testing"
 )
 
@@ -63,3 +64,27 @@ func TestSplayName(t *testing.T) {
 
 	_ = s.RemoveAll()
 }
+
+func TestSplayPath(t *testing.T) {
+	s, err := NewSplay("testdata", 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.RemoveAll()
+
+	path, err := s.Path("speaker")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := filepath.Join("testdata", "spe", "aker"); path != want {
+		t.Fatalf("expected %s got %s", want, path)
+	}
+
+	if _, err = s.Path("spe"); err != ErrInvalidName {
+		t.Fatal("invalid name accepted")
+	}
+}
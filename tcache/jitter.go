@@ -0,0 +1,70 @@
+package tcache
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// WithJitter randomizes each expiry to within frac of the duration, so caches
+// created together do not refresh in lockstep. For example with a duration of
+// 10 seconds and frac 0.1, values expire after 9 to 11 seconds. Frac must be
+// in [0, 1). Overrides WithJitterRange.
+func WithJitter(frac float64) Option {
+	return func(o *options) {
+		o.jitterFrac = frac
+	}
+}
+
+// WithJitterRange randomizes each expiry by adding an offset in [min, max] to
+// the duration. Min may be negative, but the duration plus min must be
+// positive.
+func WithJitterRange(min, max time.Duration) Option {
+	return func(o *options) {
+		o.jitterMin = min
+		o.jitterMax = max
+	}
+}
+
+// WithRandomStart expires the first value after a random offset within the
+// duration, so caches created together are spread out from the start. With
+// WithBackground this is when the first background refresh happens. Map
+// ignores this option.
+func WithRandomStart() Option {
+	return func(o *options) {
+		o.randomStart = true
+	}
+}
+
+func (o *options) validate(dur time.Duration) error {
+	if o.jitterFrac < 0 || o.jitterFrac >= 1 {
+		return errors.New("tcache: jitter fraction not in [0, 1)")
+	} else if o.jitterMin > o.jitterMax {
+		return errors.New("tcache: jitter min > max")
+	} else if dur+o.jitterMin <= 0 {
+		return errors.New("tcache: duration + jitter min <= 0")
+	}
+
+	return nil
+}
+
+// ttl returns how long a value filled now stays fresh. First is whether this is
+// the first fill of the cache.
+func (o *options) ttl(dur time.Duration, first bool) time.Duration {
+	if first && o.randomStart {
+		return time.Duration(rand.Int63n(int64(dur))) + 1
+	}
+
+	lo, hi := o.jitterMin, o.jitterMax
+
+	if o.jitterFrac > 0 {
+		hi = time.Duration(o.jitterFrac * float64(dur))
+		lo = -hi
+	}
+
+	if lo == hi {
+		return dur + lo
+	}
+
+	return dur + lo + time.Duration(rand.Int63n(int64(hi-lo)+1))
+}
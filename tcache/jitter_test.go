@@ -0,0 +1,92 @@
+package tcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/esote/util/clock"
+)
+
+// Test that jittered expiries stay within their bounds.
+func TestJitterBounds(t *testing.T) {
+	const dur = 10 * time.Second
+
+	tests := []struct {
+		opts   []Option
+		first  bool
+		lo, hi time.Duration
+	}{
+		{nil, false, dur, dur},
+		{[]Option{WithJitter(0.1)}, false, 9 * time.Second, 11 * time.Second},
+		{[]Option{WithJitterRange(-time.Second, 0)}, false, 9 * time.Second, dur},
+		{[]Option{WithRandomStart()}, true, 1, dur},
+		{[]Option{WithRandomStart(), WithJitter(0.5)}, false, 5 * time.Second, 15 * time.Second},
+	}
+
+	for i, test := range tests {
+		o := newOptions(test.opts)
+
+		if err := o.validate(dur); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 1000; j++ {
+			if d := o.ttl(dur, test.first); d < test.lo || d > test.hi {
+				t.Fatalf("test %d: %s not in [%s, %s]", i, d, test.lo,
+					test.hi)
+			}
+		}
+	}
+}
+
+func TestJitterInvalid(t *testing.T) {
+	fill := func() interface{} {
+		return 1
+	}
+
+	invalid := []Option{
+		WithJitter(-0.1),
+		WithJitter(1),
+		WithJitterRange(time.Second, 0),
+		WithJitterRange(-time.Minute, 0),
+	}
+
+	for i, opt := range invalid {
+		if _, err := NewTCache(time.Minute, fill, opt); err == nil {
+			t.Fatalf("option %d accepted", i)
+		}
+	}
+}
+
+// Test that TCache expires according to the jittered duration.
+func TestJitterExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+
+	var fills int
+
+	fill := func() interface{} {
+		fills++
+		return fills
+	}
+
+	c, _ := NewTCache(10*time.Second, fill, WithClock(clk),
+		WithJitterRange(time.Second, 2*time.Second))
+
+	for i := 1; i <= 10; i++ {
+		if v := c.Next(); v != i {
+			t.Fatalf("expected %d got %v", i, v)
+		}
+
+		clk.Advance(11 * time.Second)
+
+		if _, fresh := c.Peek(); !fresh {
+			t.Fatal("expired before jitter")
+		}
+
+		clk.Advance(time.Second + 1)
+
+		if _, fresh := c.Peek(); fresh {
+			t.Fatal("fresh after jitter")
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package tcache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Map is a keyed timed cache. Each key refreshes independently after a certain
+// duration. Concurrent fills for the same key are de-duplicated, and the least
+// recently used keys are evicted when the cache grows beyond its size.
+type Map[K comparable, V any] struct {
+	dur   time.Duration
+	fill  func(context.Context, K) (V, error)
+	items map[K]*list.Element
+	lru   *list.List
+	mu    sync.Mutex
+	opts  options
+	size  int
+	stats Stats
+}
+
+type entry[K comparable, V any] struct {
+	call  *call[V]
+	key   K
+	last  time.Time
+	ok    bool
+	ttl   time.Duration
+	value V
+}
+
+// call is an in-flight fill, shared by all callers waiting on the same key.
+// The fill is cancelled once all of its waiters have left.
+type call[V any] struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	err     error
+	value   V
+	waiters int
+}
+
+// NewMap creates a new keyed timed cache holding at most size keys.
+func NewMap[K comparable, V any](dur time.Duration, size int, fill func(context.Context, K) (V, error), opts ...Option) (*Map[K, V], error) {
+	if dur <= 0 {
+		return nil, errors.New("tcache: duration <= 0")
+	} else if size <= 0 {
+		return nil, errors.New("tcache: size <= 0")
+	} else if fill == nil {
+		return nil, errors.New("tcache: fill is nil")
+	}
+
+	o := newOptions(opts)
+
+	if err := o.validate(dur); err != nil {
+		return nil, err
+	}
+
+	return &Map[K, V]{
+		dur:   dur,
+		fill:  fill,
+		items: make(map[K]*list.Element),
+		lru:   list.New(),
+		opts:  o,
+		size:  size,
+	}, nil
+}
+
+// Get retrieves the value for key, filling it if it is missing or expired. If
+// a fill for key is already in progress, Get waits for its result instead of
+// starting another. The fill runs with its own context, which is cancelled
+// only once every Get waiting on it has returned because its ctx was done.
+// Fill errors are returned and not cached, and a panicking fill is returned as
+// an error.
+func (m *Map[K, V]) Get(ctx context.Context, key K) (V, error) {
+	m.mu.Lock()
+
+	el, ok := m.items[key]
+
+	if !ok {
+		el = m.lru.PushFront(&entry[K, V]{key: key})
+		m.items[key] = el
+		m.evict()
+	} else {
+		m.lru.MoveToFront(el)
+	}
+
+	e := el.Value.(*entry[K, V])
+
+	if e.ok && m.opts.clock.Now().UTC().Sub(e.last) <= e.ttl {
+		ret := e.value
+		m.stats.Hits++
+		m.mu.Unlock()
+		return ret, nil
+	}
+
+	m.stats.Misses++
+
+	c := e.call
+
+	if c == nil {
+		fctx, cancel := context.WithCancel(context.Background())
+		c = &call[V]{
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		e.call = c
+
+		go m.run(fctx, el, c)
+	}
+
+	c.waiters++
+
+	m.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+
+	if c.waiters--; c.waiters == 0 {
+		// Nobody is left waiting on the fill.
+		c.cancel()
+
+		if e.call == c {
+			e.call = nil
+			m.remove(el)
+		}
+	}
+
+	m.mu.Unlock()
+
+	var zero V
+	return zero, ctx.Err()
+}
+
+// run fills the entry of el for the waiters of c.
+func (m *Map[K, V]) run(ctx context.Context, el *list.Element, c *call[V]) {
+	e := el.Value.(*entry[K, V])
+	start := m.opts.fillStart()
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("tcache: fill panicked: %v", r)
+		}
+
+		d := m.opts.fillEnd(start, c.err)
+
+		m.mu.Lock()
+
+		m.stats.fill(d, c.err)
+
+		if e.call == c {
+			e.call = nil
+
+			// The key may have been deleted or evicted while filling,
+			// in which case the result is handed to the waiters but
+			// not stored.
+			if c.err == nil && m.items[e.key] == el {
+				e.value = c.value
+				e.last = m.opts.clock.Now().UTC()
+				e.ttl = m.opts.ttl(m.dur, false)
+				e.ok = true
+			} else if c.err != nil {
+				m.remove(el)
+			}
+		}
+
+		m.mu.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.value, c.err = m.fill(ctx, e.key)
+}
+
+// Delete removes key from the cache. A fill in progress for key still
+// completes, but its result is not stored.
+func (m *Map[K, V]) Delete(key K) {
+	m.mu.Lock()
+
+	if el, ok := m.items[key]; ok {
+		m.lru.Remove(el)
+		delete(m.items, key)
+	}
+
+	m.mu.Unlock()
+}
+
+// Purge removes all keys from the cache.
+func (m *Map[K, V]) Purge() {
+	m.mu.Lock()
+
+	m.items = make(map[K]*list.Element)
+	m.lru.Init()
+
+	m.mu.Unlock()
+}
+
+// Len returns the number of keys in the cache.
+func (m *Map[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lru.Len()
+}
+
+// Stats returns the cache statistics. Map never serves stale values.
+func (m *Map[K, V]) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stats
+}
+
+// remove deletes the entry of el if it was never filled, so failed fills do
+// not take up space. Must be called with the mutex held.
+func (m *Map[K, V]) remove(el *list.Element) {
+	e := el.Value.(*entry[K, V])
+
+	if !e.ok && m.items[e.key] == el {
+		m.lru.Remove(el)
+		delete(m.items, e.key)
+	}
+}
+
+// evict removes least recently used keys until the cache fits its size. Must
+// be called with the mutex held.
+func (m *Map[K, V]) evict() {
+	for m.lru.Len() > m.size {
+		el := m.lru.Back()
+		m.lru.Remove(el)
+		delete(m.items, el.Value.(*entry[K, V]).key)
+	}
+}
@@ -0,0 +1,284 @@
+package tcache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/esote/util/clock"
+)
+
+// Test that each key is filled and refreshed independently.
+func TestMapRefresh(t *testing.T) {
+	var fills uint64
+
+	fill := func(_ context.Context, k string) (uint64, error) {
+		return atomic.AddUint64(&fills, 1), nil
+	}
+
+	clk := clock.NewFake(time.Now())
+	m, err := NewMap(100*time.Millisecond, 10, fill, WithClock(clk))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	a1, _ := m.Get(ctx, "a")
+	b1, _ := m.Get(ctx, "b")
+
+	if a1 == b1 {
+		t.Fatal("keys share a value")
+	}
+
+	if a2, _ := m.Get(ctx, "a"); a2 != a1 {
+		t.Fatal("refreshed too early")
+	}
+
+	clk.Advance(150 * time.Millisecond)
+
+	if a2, _ := m.Get(ctx, "a"); a2 == a1 {
+		t.Fatal("did not refresh")
+	}
+}
+
+// Test that concurrent Gets for the same key share a single fill.
+func TestMapSingleflight(t *testing.T) {
+	var fills uint64
+	release := make(chan struct{})
+
+	fill := func(_ context.Context, k int) (int, error) {
+		atomic.AddUint64(&fills, 1)
+		<-release
+		return k, nil
+	}
+
+	m, _ := NewMap(time.Hour, 10, fill)
+
+	const reps = 100
+
+	var wg sync.WaitGroup
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func() {
+			defer wg.Done()
+			if v, err := m.Get(context.Background(), 7); err != nil || v != 7 {
+				t.Errorf("got %d, %v", v, err)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fills != 1 {
+		t.Fatalf("expected 1 fill got %d", fills)
+	}
+}
+
+// Test that fill errors are returned and not cached.
+func TestMapError(t *testing.T) {
+	fail := true
+	errFill := errors.New("fill failed")
+
+	fill := func(_ context.Context, k int) (int, error) {
+		if fail {
+			return 0, errFill
+		}
+		return k, nil
+	}
+
+	m, _ := NewMap(time.Hour, 10, fill)
+
+	if _, err := m.Get(context.Background(), 1); err != errFill {
+		t.Fatalf("expected %v got %v", errFill, err)
+	}
+
+	if n := m.Len(); n != 0 {
+		t.Fatalf("failed fill kept, len %d", n)
+	}
+
+	fail = false
+
+	if v, err := m.Get(context.Background(), 1); err != nil || v != 1 {
+		t.Fatalf("got %d, %v", v, err)
+	}
+
+	panicky := func(_ context.Context, k int) (int, error) {
+		if k == 1 {
+			panic("oops")
+		}
+		return k, nil
+	}
+
+	m, _ = NewMap(time.Hour, 10, panicky)
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.Get(context.Background(), 1); err == nil {
+			t.Fatal("panic not returned")
+		}
+	}
+
+	if n := m.Len(); n != 0 {
+		t.Fatalf("panicked fill kept, len %d", n)
+	}
+}
+
+// Test that a waiter leaving does not cancel the fill for other waiters, and
+// that the fill is cancelled once all have left.
+func TestMapCancel(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fill := func(ctx context.Context, k int) (int, error) {
+		started <- struct{}{}
+		wait := release
+		if k == 2 {
+			// Only returns once cancelled.
+			wait = nil
+		}
+		select {
+		case <-wait:
+			return k, nil
+		case <-ctx.Done():
+			close(cancelled)
+			return 0, ctx.Err()
+		}
+	}
+
+	m, _ := NewMap(time.Hour, 10, fill)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := make(chan error)
+
+	go func() {
+		_, err := m.Get(ctx1, 1)
+		done1 <- err
+	}()
+
+	<-started
+
+	done2 := make(chan error)
+
+	go func() {
+		_, err := m.Get(context.Background(), 1)
+		done2 <- err
+	}()
+
+	// Wait for the second Get to join the fill.
+	for {
+		m.mu.Lock()
+		n := m.items[1].Value.(*entry[int, int]).call.waiters
+		m.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel1()
+
+	if err := <-done1; err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	close(release)
+
+	if err := <-done2; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	done3 := make(chan error)
+
+	go func() {
+		_, err := m.Get(ctx3, 2)
+		done3 <- err
+	}()
+
+	<-started
+	cancel3()
+	<-done3
+	<-cancelled
+
+	if n := m.Len(); n != 1 {
+		t.Fatalf("expected len 1 got %d", n)
+	}
+}
+
+// Test least recently used eviction, Delete, and Purge.
+func TestMapEvict(t *testing.T) {
+	var fills uint64
+
+	fill := func(_ context.Context, k int) (int, error) {
+		atomic.AddUint64(&fills, 1)
+		return k, nil
+	}
+
+	m, _ := NewMap(time.Hour, 2, fill)
+	ctx := context.Background()
+
+	_, _ = m.Get(ctx, 1)
+	_, _ = m.Get(ctx, 2)
+	_, _ = m.Get(ctx, 1)
+	_, _ = m.Get(ctx, 3) // evicts 2
+
+	if n := m.Len(); n != 2 {
+		t.Fatalf("expected len 2 got %d", n)
+	}
+
+	_, _ = m.Get(ctx, 1)
+
+	if fills != 3 {
+		t.Fatalf("expected 3 fills got %d", fills)
+	}
+
+	_, _ = m.Get(ctx, 2)
+
+	if fills != 4 {
+		t.Fatalf("expected 4 fills got %d", fills)
+	}
+
+	m.Delete(2)
+
+	if n := m.Len(); n != 1 {
+		t.Fatalf("expected len 1 got %d", n)
+	}
+
+	m.Purge()
+
+	if n := m.Len(); n != 0 {
+		t.Fatalf("expected len 0 got %d", n)
+	}
+}
+
+// Test for race conditions when calling Get concurrently, run with the -race
+// flag.
+func TestMapRace(t *testing.T) {
+	fill := func(_ context.Context, k int) (int, error) {
+		return k, nil
+	}
+
+	m, _ := NewMap(time.Millisecond, 5, fill)
+
+	reps := 1000
+
+	var wg sync.WaitGroup
+	wg.Add(reps)
+	for i := 0; i < reps; i++ {
+		go func(i int) {
+			_, _ = m.Get(context.Background(), i%10)
+			if i%100 == 0 {
+				m.Delete(i % 10)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,80 @@
+package tcache
+
+import "time"
+
+// Stats describes how effective a cache has been.
+type Stats struct {
+	// Hits counts values served fresh without waiting on a fill.
+	Hits uint64
+
+	// Misses counts values served only after waiting on a fill.
+	Misses uint64
+
+	// Stale counts values served stale while another caller was filling,
+	// see WithStale.
+	Stale uint64
+
+	// Fills counts calls to fill, including those which failed.
+	Fills uint64
+
+	// FillErrors counts calls to fill which returned an error. Always zero
+	// for TCache, whose fill cannot fail.
+	FillErrors uint64
+
+	// FillTime is the cumulative time spent in fill.
+	FillTime time.Duration
+
+	// LastFillTime is the time spent in the most recent fill.
+	LastFillTime time.Duration
+}
+
+// Observer is notified when a cache is filled, for example to export metrics.
+// Its methods are called from the filling goroutine and should not block.
+type Observer interface {
+	// FillStart is called before fill.
+	FillStart()
+
+	// FillEnd is called after fill with the time it took and the error it
+	// returned, if any.
+	FillEnd(d time.Duration, err error)
+}
+
+// WithObserver sets an observer notified of every fill.
+func WithObserver(obs Observer) Option {
+	return func(o *options) {
+		o.observer = obs
+	}
+}
+
+// fillStart notifies the observer that a fill is starting and returns the
+// start time.
+func (o *options) fillStart() time.Time {
+	if o.observer != nil {
+		o.observer.FillStart()
+	}
+
+	return o.clock.Now()
+}
+
+// fillEnd notifies the observer that a fill started at start has ended, and
+// returns its duration.
+func (o *options) fillEnd(start time.Time, err error) time.Duration {
+	d := o.clock.Now().Sub(start)
+
+	if o.observer != nil {
+		o.observer.FillEnd(d, err)
+	}
+
+	return d
+}
+
+func (s *Stats) fill(d time.Duration, err error) {
+	s.Fills++
+
+	if err != nil {
+		s.FillErrors++
+	}
+
+	s.FillTime += d
+	s.LastFillTime = d
+}
@@ -0,0 +1,110 @@
+package tcache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/esote/util/clock"
+)
+
+type recorder struct {
+	starts int
+	ends   []time.Duration
+	errs   []error
+}
+
+func (r *recorder) FillStart() {
+	r.starts++
+}
+
+func (r *recorder) FillEnd(d time.Duration, err error) {
+	r.ends = append(r.ends, d)
+	r.errs = append(r.errs, err)
+}
+
+func TestStats(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rec := &recorder{}
+
+	fill := func() interface{} {
+		clk.Advance(10 * time.Millisecond)
+		return 1
+	}
+
+	c, _ := NewTCache(time.Second, fill, WithClock(clk), WithObserver(rec))
+
+	_ = c.Next()
+	_ = c.Next()
+	_ = c.Next()
+
+	clk.Advance(2 * time.Second)
+
+	_ = c.Next()
+
+	if _, err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Stats{
+		Hits:         2,
+		Misses:       2,
+		Fills:        3,
+		FillTime:     30 * time.Millisecond,
+		LastFillTime: 10 * time.Millisecond,
+	}
+
+	if s := c.Stats(); s != want {
+		t.Fatalf("expected %+v got %+v", want, s)
+	}
+
+	if rec.starts != 3 || len(rec.ends) != 3 {
+		t.Fatalf("observed %d starts %d ends", rec.starts, len(rec.ends))
+	}
+
+	for i, d := range rec.ends {
+		if d != 10*time.Millisecond || rec.errs[i] != nil {
+			t.Fatalf("observed fill %d: %s, %v", i, d, rec.errs[i])
+		}
+	}
+}
+
+func TestMapStats(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rec := &recorder{}
+	errFill := errors.New("fill failed")
+
+	fill := func(_ context.Context, k int) (int, error) {
+		clk.Advance(time.Millisecond)
+		if k < 0 {
+			return 0, errFill
+		}
+		return k, nil
+	}
+
+	m, _ := NewMap(time.Second, 10, fill, WithClock(clk), WithObserver(rec))
+	ctx := context.Background()
+
+	_, _ = m.Get(ctx, 1)
+	_, _ = m.Get(ctx, 1)
+	_, _ = m.Get(ctx, -1)
+	_, _ = m.Get(ctx, 2)
+
+	want := Stats{
+		Hits:         1,
+		Misses:       3,
+		Fills:        3,
+		FillErrors:   1,
+		FillTime:     3 * time.Millisecond,
+		LastFillTime: time.Millisecond,
+	}
+
+	if s := m.Stats(); s != want {
+		t.Fatalf("expected %+v got %+v", want, s)
+	}
+
+	if rec.starts != 3 || len(rec.errs) != 3 || rec.errs[1] != errFill {
+		t.Fatalf("observed %d starts, errors %v", rec.starts, rec.errs)
+	}
+}
@@ -2,9 +2,12 @@
 package tcache
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
+
+	"github.com/esote/util/clock"
 )
 
 // TCache (timed cache) is a cache which refreshes only after a certain
@@ -12,41 +15,271 @@ import (
 //
 // This is the "memory" version of FCache.
 type TCache struct {
-	cache interface{}
-	dur   time.Duration
-	fill  func() interface{}
-	last  time.Time
-	mu    sync.Mutex
+	cache   interface{}
+	call    chan struct{}
+	dur     time.Duration
+	fill    func() interface{}
+	filled  bool
+	gen     uint64
+	invalid bool
+	last    time.Time
+	mu      sync.Mutex
+	opts    options
+	stats   Stats
+	stopped bool
+	timer   clock.Timer
+	ttl     time.Duration
+}
+
+// Option configures a timed cache.
+type Option func(*options)
+
+type options struct {
+	background  bool
+	clock       clock.Clock
+	jitterFrac  float64
+	jitterMax   time.Duration
+	jitterMin   time.Duration
+	observer    Observer
+	randomStart bool
+	stale       bool
+}
+
+// WithBackground makes TCache refresh itself every duration once it has been
+// filled, so Next rarely has to wait on fill. Call Stop to end the background
+// refreshes. Map ignores this option.
+func WithBackground() Option {
+	return func(o *options) {
+		o.background = true
+	}
+}
+
+// WithClock sets the clock used to tell time and schedule background
+// refreshes, by default clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithStale makes Next return the previous value, rather than wait, while
+// another caller is refreshing an expired cache. Map ignores this option.
+func WithStale() Option {
+	return func(o *options) {
+		o.stale = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		clock: clock.Real,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
 }
 
 // NewTCache creates a new timed cache.
-func NewTCache(dur time.Duration, fill func() interface{}) (*TCache, error) {
+func NewTCache(dur time.Duration, fill func() interface{}, opts ...Option) (*TCache, error) {
 	if dur <= 0 {
 		return nil, errors.New("tcache: duration <= 0")
 	} else if fill == nil {
 		return nil, errors.New("tcache: fill is nil")
 	}
 
+	o := newOptions(opts)
+
+	if err := o.validate(dur); err != nil {
+		return nil, err
+	}
+
 	return &TCache{
 		cache: nil,
 		dur:   dur,
 		fill:  fill,
-		last:  time.Now().UTC().Add(-dur),
+		opts:  o,
 	}, nil
 }
 
 // Next retrieves the value in the cache.
 func (t *TCache) Next() interface{} {
+	ret, _, _ := t.NextWithAge()
+	return ret
+}
+
+// NextWithAge retrieves the value in the cache, the time it was filled, and
+// whether it was served stale because another caller is refreshing it.
+func (t *TCache) NextWithAge() (interface{}, time.Time, bool) {
 	t.mu.Lock()
 
-	if time := time.Now().UTC(); time.Sub(t.last) > t.dur {
-		t.last = time
-		t.cache = t.fill()
+	if !t.expired(t.opts.clock.Now().UTC()) {
+		t.stats.Hits++
+		ret, last := t.cache, t.last
+		t.mu.Unlock()
+		return ret, last, false
+	}
+
+	if c := t.call; c != nil {
+		if t.opts.stale && t.filled {
+			t.stats.Stale++
+			ret, last := t.cache, t.last
+			t.mu.Unlock()
+			return ret, last, true
+		}
+
+		t.mu.Unlock()
+		<-c
+		t.mu.Lock()
+	} else {
+		t.refresh()
 	}
 
+	t.stats.Misses++
+
+	ret, last := t.cache, t.last
+
+	t.mu.Unlock()
+
+	return ret, last, false
+}
+
+// Peek retrieves the value in the cache without filling it, and whether the
+// value is still fresh. The value is nil if the cache has never been filled.
+func (t *TCache) Peek() (interface{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.cache, !t.expired(t.opts.clock.Now().UTC())
+}
+
+// Invalidate expires the value in the cache, so the next call to Next will
+// refresh it.
+func (t *TCache) Invalidate() {
+	t.mu.Lock()
+	t.gen++
+	t.invalid = true
+	t.mu.Unlock()
+}
+
+// Refresh fills the cache regardless of its expiry and returns the new value.
+// If another refresh is in progress, Refresh waits for it to finish first. An
+// error is only returned if ctx is done before the fill starts.
+func (t *TCache) Refresh(ctx context.Context) (interface{}, error) {
+	t.mu.Lock()
+
+	for t.call != nil {
+		c := t.call
+
+		t.mu.Unlock()
+
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		t.mu.Lock()
+	}
+
+	t.refresh()
+
 	ret := t.cache
 
 	t.mu.Unlock()
 
-	return ret
+	return ret, nil
+}
+
+// Stats returns the cache statistics.
+func (t *TCache) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stats
+}
+
+// Stop ends background refreshes. The cache can still be used, refreshing only
+// when expired.
+func (t *TCache) Stop() {
+	t.mu.Lock()
+
+	t.stopped = true
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	t.mu.Unlock()
+}
+
+// expired reports whether the cache must be refreshed. Must be called with the
+// mutex held.
+func (t *TCache) expired(now time.Time) bool {
+	return !t.filled || t.invalid || now.Sub(t.last) > t.ttl
+}
+
+// refresh fills the cache. Must be called with the mutex held and no other
+// refresh in progress; the mutex is released while filling. If fill panics,
+// waiters are released and the panic continues with the mutex unlocked.
+func (t *TCache) refresh() {
+	c := make(chan struct{})
+	t.call = c
+	gen := t.gen
+
+	t.mu.Unlock()
+
+	filled := false
+
+	defer func() {
+		if !filled {
+			t.mu.Lock()
+			t.call = nil
+			close(c)
+			t.mu.Unlock()
+		}
+	}()
+
+	start := t.opts.fillStart()
+	ret := t.fill()
+	d := t.opts.fillEnd(start, nil)
+
+	filled = true
+
+	t.mu.Lock()
+
+	t.stats.fill(d, nil)
+
+	t.cache = ret
+	t.last = t.opts.clock.Now().UTC()
+	t.ttl = t.opts.ttl(t.dur, !t.filled)
+	t.filled = true
+	t.call = nil
+
+	// Keep the cache invalid if Invalidate was called while filling.
+	t.invalid = t.gen != gen
+
+	if t.opts.background && !t.stopped {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+
+		t.timer = t.opts.clock.AfterFunc(t.ttl, t.tick)
+	}
+
+	close(c)
+}
+
+// tick is the background refresh.
+func (t *TCache) tick() {
+	t.mu.Lock()
+
+	// An in-progress refresh will schedule the next tick itself.
+	if !t.stopped && t.call == nil {
+		t.refresh()
+	}
+
+	t.mu.Unlock()
 }
@@ -1,28 +1,33 @@
 package tcache
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/esote/util/clock"
 )
 
 // Test that the cache refreshes when it should.
 func TestRefresh(t *testing.T) {
 	dur := 250 * time.Millisecond
+	clk := clock.NewFake(time.Now())
+
+	var fills int
 
 	fill := func() interface{} {
-		return rand.Intn(3)
+		fills++
+		return fills
 	}
 
-	c, err := NewTCache(dur, fill)
+	c, err := NewTCache(dur, fill, WithClock(clk))
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var prev interface{}
-
 	for i := 0; i < 11; i++ {
 		n := c.Next()
 
@@ -30,18 +35,64 @@ func TestRefresh(t *testing.T) {
 			t.Fatal("nil returned")
 		}
 
-		// It is possible for this to fail due to a timing skew, but
-		// that should be rare.
-		switch {
-		case i == 0 || i == 5:
-			prev = n
-		case i < 5 || (i > 5 && i < 10):
-			if n != prev {
-				t.Fatal("refreshed out of sync")
-			}
+		// Refreshes only once more than dur has passed, at i == 6.
+		want := 1
+		if i > 5 {
+			want = 2
+		}
+
+		if n != want {
+			t.Fatalf("refreshed out of sync at %d: expected %d got %v",
+				i, want, n)
 		}
 
-		time.Sleep(50 * time.Millisecond)
+		clk.Advance(50 * time.Millisecond)
+	}
+}
+
+// Test that background refreshes keep the cache fresh until stopped.
+func TestBackground(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+
+	var fills int
+
+	fill := func() interface{} {
+		fills++
+		return fills
+	}
+
+	c, _ := NewTCache(time.Second, fill, WithClock(clk), WithBackground())
+
+	// Nothing is scheduled before the first fill.
+	clk.Advance(time.Minute)
+
+	if fills != 0 {
+		t.Fatalf("expected 0 fills got %d", fills)
+	}
+
+	if v := c.Next(); v != 1 {
+		t.Fatalf("expected %d got %v", 1, v)
+	}
+
+	clk.Advance(3 * time.Second)
+
+	if fills != 4 {
+		t.Fatalf("expected 4 fills got %d", fills)
+	}
+
+	if _, fresh := c.Peek(); !fresh {
+		t.Fatal("background refresh left cache expired")
+	}
+
+	c.Stop()
+	clk.Advance(3 * time.Second)
+
+	if fills != 4 {
+		t.Fatalf("expected 4 fills after stop got %d", fills)
+	}
+
+	if v := c.Next(); v != 5 {
+		t.Fatalf("expected %d got %v", 5, v)
 	}
 }
 
@@ -70,6 +121,112 @@ func TestRace(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that Invalidate and Refresh cause the cache to refill early.
+func TestInvalidateRefresh(t *testing.T) {
+	var n int
+
+	fill := func() interface{} {
+		n++
+		return n
+	}
+
+	c, _ := NewTCache(time.Hour, fill)
+
+	if v, fresh := c.Peek(); v != nil || fresh {
+		t.Fatal("peek filled the cache")
+	}
+
+	if v := c.Next(); v != 1 {
+		t.Fatalf("expected %d got %v", 1, v)
+	}
+
+	if v, fresh := c.Peek(); v != 1 || !fresh {
+		t.Fatalf("expected fresh %d got %v, %t", 1, v, fresh)
+	}
+
+	c.Invalidate()
+
+	if v, fresh := c.Peek(); v != 1 || fresh {
+		t.Fatalf("expected stale %d got %v, %t", 1, v, fresh)
+	}
+
+	if v := c.Next(); v != 2 {
+		t.Fatalf("expected %d got %v", 2, v)
+	}
+
+	v, err := c.Refresh(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != 3 {
+		t.Fatalf("expected %d got %v", 3, v)
+	}
+
+	if v := c.Next(); v != 3 {
+		t.Fatalf("expected %d got %v", 3, v)
+	}
+}
+
+// Test that NextWithAge reports fill time and stale serves.
+func TestNextWithAge(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	block := false
+
+	fill := func() interface{} {
+		if block {
+			started <- struct{}{}
+			<-release
+		}
+		return rand.Intn(3)
+	}
+
+	clk := clock.NewFake(time.Now())
+	c, _ := NewTCache(time.Hour, fill, WithStale(), WithClock(clk))
+
+	v1, last, stale := c.NextWithAge()
+
+	if stale {
+		t.Fatal("first value stale")
+	}
+
+	if !last.Equal(clk.Now().UTC()) {
+		t.Fatal("wrong fill time")
+	}
+
+	clk.Advance(time.Minute)
+
+	block = true
+	c.Invalidate()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = c.Refresh(context.Background())
+		close(done)
+	}()
+
+	<-started
+
+	v2, last2, stale := c.NextWithAge()
+
+	if !stale || v2 != v1 || !last2.Equal(last) {
+		t.Fatal("expected previous value served stale")
+	}
+
+	if n := c.Stats().Stale; n != 1 {
+		t.Fatalf("expected 1 stale serve got %d", n)
+	}
+
+	close(release)
+	<-done
+
+	if _, last2, stale = c.NextWithAge(); stale || !last2.After(last) {
+		t.Fatal("expected fresh value after refresh")
+	}
+}
+
 func BenchmarkNext(b *testing.B) {
 	dur := 5 * time.Millisecond
 
@@ -98,3 +255,38 @@ func expOp() interface{} {
 	time.Sleep(time.Millisecond)
 	return rand.Intn(3)
 }
+
+// Test that a panicking fill can be recovered by the caller, and does not
+// block later calls.
+func TestPanic(t *testing.T) {
+	fail := true
+
+	fill := func() interface{} {
+		if fail {
+			panic("oops")
+		}
+		return 1
+	}
+
+	c, _ := NewTCache(time.Hour, fill)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "oops" {
+				t.Fatalf("expected panic got %v", r)
+			}
+		}()
+
+		c.Next()
+	}()
+
+	fail = false
+
+	if v := c.Next(); v != 1 {
+		t.Fatalf("expected %d got %v", 1, v)
+	}
+
+	if v, err := c.Refresh(context.Background()); err != nil || v != 1 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+}